@@ -4,70 +4,93 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
+	"reflect"
+	"slices"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// addPlacement adds tolerations, nodeSelector, priorityClass, container env vars.
-func addPlacement(namespace, podName, priorityClassName string,
-	priority *int32,
-	podLabels map[string]string,
-	ownerReferences []metav1.OwnerReference,
-	containers []corev1.Container,
+// addPlacement adds tolerations, nodeSelector, priorityClass, container env vars
+// to the pod spec. It returns the rules that changed the spec.
+//
+// placePods must be in evaluation order, see orderRules().
+// A rule group with strategy merge applies all its matching placements,
+// otherwise only its first matching placement applies.
+// A matching placement with final stops the evaluation.
+// Placements from several rule groups are merged.
+func addPlacement(pod podInfo, spec *corev1.PodSpec,
 	placePods []placementConfig) []string {
 
-	//
-	// scan pod add rules
-	//
-	for _, pc := range placePods {
-
-		if pc.match(namespace, podName, priorityClassName, podLabels,
-			ownerReferences) {
-			//
-			// found add rule for pod
-			//
-			return addOne(namespace, podName, priorityClassName, priority,
-				containers, pc.Add)
-		}
+	me := fmt.Sprintf("addPlacement: %s/%s", pod.namespace, pod.name)
+
+	matched, ids := selectRules(me, placePods,
+		func(pc placementConfig) bool { return pc.match(pod) })
+
+	if len(matched) == 0 {
+		return nil
 	}
 
-	return nil
+	add := matched[0].Add
+	if len(matched) > 1 {
+		add = mergePlacements(me, matched)
+	}
+
+	if !addOne(pod.namespace, pod.name, spec, add) {
+		return nil
+	}
+	return ids
 }
 
-func addOne(namespace, podName, priorityClassName string, priority *int32,
-	containers []corev1.Container, add addConfig) []string {
+// addOne applies the add section to the pod spec.
+// It reports whether the spec was changed.
+func addOne(namespace, podName string, spec *corev1.PodSpec, add addConfig) bool {
 
-	var list []string
+	var changed bool
 
 	for _, tol := range add.Tolerations {
-		list = append(list, addToleration(namespace, podName, tol))
+		if addToleration(namespace, podName, spec, tol) {
+			changed = true
+		}
 	}
 
 	if len(add.NodeSelector) > 0 {
-		ns, errNs := addNodeSelector(namespace, podName, add.NodeSelector)
-		if errNs != nil {
-			log.Printf("ERROR: addOne: %v", errNs)
-			return list
+		if addNodeSelector(namespace, podName, spec, add.NodeSelector,
+			add.NodeSelectorOnConflict) {
+			changed = true
+		}
+	}
+
+	// volumes first, for the volume mounts
+	var skippedVolumes map[string]bool
+	if len(add.Volumes) > 0 {
+		var volumesChanged bool
+		volumesChanged, skippedVolumes = addVolumes(namespace, podName, spec,
+			add.Volumes)
+		if volumesChanged {
+			changed = true
 		}
-		list = append(list, ns)
 	}
 
 	if len(add.Containers) > 0 {
-		list = append(list, addContainerEnv(namespace, podName, containers,
-			add.Containers)...)
+		if addContainers(namespace, podName, spec, add.Containers,
+			skippedVolumes) {
+			changed = true
+		}
 	}
 
 	if add.PriorityClassName != "" {
-		list = append(list, setPriorityClass(namespace, podName,
-			add.PriorityClassName, priorityClassName, priority)...)
+		if setPriorityClass(namespace, podName, spec, add.PriorityClassName) {
+			changed = true
+		}
 	}
 
-	return list
+	return changed
 }
 
-func setPriorityClass(namespace, podName, newClass, oldClass string, priority *int32) []string {
-	var list []string
+func setPriorityClass(namespace, podName string, spec *corev1.PodSpec, newClass string) bool {
+	oldClass := spec.PriorityClassName
+	priority := spec.Priority
 
 	var priorityStr string
 	if priority != nil {
@@ -83,103 +106,354 @@ func setPriorityClass(namespace, podName, newClass, oldClass string, priority *i
 
 	if !classChanged {
 		// no change to priority class, so do not modify priority or priorityClassName
-		return list
+		return false
 	}
 
-	// add or replace priorityClassName
-	str := fmt.Sprintf(`{"op":"add","path":"/spec/priorityClassName","value":"%s"}`,
-		newClass)
-	list = append(list, str)
+	spec.PriorityClassName = newClass
 
-	// remove priority if set
-	if priority != nil {
-		str := `{"op":"remove","path":"/spec/priority"}`
-		list = append(list, str)
-	}
+	// remove priority, the api-server resolves it from the new class
+	spec.Priority = nil
 
-	return list
+	return true
 }
 
-func addContainerEnv(namespace, podName string, containers []corev1.Container,
-	addContainers map[string]containerConfig) []string {
+// Policies for an env var or envFrom source that already exists in the
+// container, set per entry or per container with on_conflict.
+const (
+	envOnConflict        = "on_conflict"
+	onConflictSkip       = "skip"
+	onConflictOverwrite  = "overwrite"
+	defaultEnvOnConflict = onConflictSkip
+
+	// a placement enforces its node selector by default
+	defaultNodeSelectorOnConflict = onConflictOverwrite
+)
 
-	containerIndex := map[string]int{}
-	containerInitialized := map[int]bool{}
+func checkOnConflict(policy string) error {
+	switch policy {
+	case "", onConflictSkip, onConflictOverwrite:
+		return nil
+	}
+	return fmt.Errorf("bad on_conflict: '%s' (expecting %s or %s)",
+		policy, onConflictSkip, onConflictOverwrite)
+}
+
+// checkRulesOnConflict validates the on_conflict policy of containers,
+// of their env and env_from entries, and of the node selector.
+func checkRulesOnConflict(r rulesConfig) error {
+	for _, pc := range r.PlacePods {
+		if err := checkOnConflict(pc.Add.NodeSelectorOnConflict); err != nil {
+			return fmt.Errorf("node_selector_on_conflict: %v", err)
+		}
+		for name, c := range pc.Add.Containers {
+			if err := checkOnConflict(c.OnConflict); err != nil {
+				return fmt.Errorf("container '%s': %v", name, err)
+			}
+			for _, entry := range slices.Concat(c.Env, c.EnvFrom) {
+				policy, errPolicy := envPolicy(entry)
+				if errPolicy != nil {
+					return fmt.Errorf("container '%s': %v", name, errPolicy)
+				}
+				if err := checkOnConflict(policy); err != nil {
+					return fmt.Errorf("container '%s': %v", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	for i, c := range containers {
-		containerIndex[c.Name] = i
+// envPolicy returns the on_conflict policy of the env or env_from entry.
+func envPolicy(env map[string]any) (string, error) {
+	v, found := env[envOnConflict]
+	if !found {
+		return defaultEnvOnConflict, nil
+	}
+	policy, isStr := v.(string)
+	if !isStr {
+		return "", fmt.Errorf("bad on_conflict type: '%v' type=%T", v, v)
+	}
+	if policy == "" {
+		return defaultEnvOnConflict, nil
 	}
+	return policy, nil
+}
 
-	var list []string
+// addContainers changes the env and the volume mounts of the containers
+// selected by each entry of add containers, see containerKeys().
+// skippedVolumes are the volumes not added because of a name collision.
+// It reports whether some container was changed.
+func addContainers(namespace, podName string, spec *corev1.PodSpec,
+	addContainers map[string]containerConfig, skippedVolumes map[string]bool) bool {
 
-	for name, c := range addContainers {
+	var changed bool
 
-		for _, env := range c.Env {
-			i, found := containerIndex[name]
-			if !found {
-				log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container not found: '%s'", namespace, podName, name)
-				continue
-			}
-			envKey := env["name"]
-			if envKey == nil {
-				log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container='%s' missing env name", namespace, podName, name)
-				continue
+	for _, key := range containerKeys(addContainers) {
+		c := addContainers[key]
+
+		containers := c.selectContainers(spec, key)
+		if len(containers) == 0 {
+			if c.name == nil {
+				log.Printf("ERROR: addContainers: ns=%s pod=%s container not found: '%s' types=%v", namespace, podName, key, itemContainerTypes(c.ContainerTypes))
+			} else {
+				log.Printf("addContainers: ns=%s pod=%s no container matches: '%s' types=%v", namespace, podName, key, itemContainerTypes(c.ContainerTypes))
 			}
-			envKeyStr, isStr := envKey.(string)
-			if !isStr {
-				log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container='%s' bad env name type: name='%v' type=%T", namespace, podName, name, envKey, envKey)
-				continue
+			continue
+		}
+
+		for _, container := range containers {
+			if applyContainerEnv(namespace, podName, container, c) {
+				changed = true
 			}
-			value, errJSON := json.Marshal(env)
-			if errJSON != nil {
-				log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container='%s' bad env json: name='%s' error=%v value=%v", namespace, podName, name, envKeyStr, errJSON, env)
-				continue
+			if addVolumeMounts(namespace, podName, spec, container,
+				c.VolumeMounts, skippedVolumes) {
+				changed = true
 			}
-			valueStr := string(value)
-			str := fmt.Sprintf(`{"op":"add","path":"/spec/containers/%d/env/-","value":%s}`, i, valueStr)
+		}
+	}
 
-			log.Printf("addContainerEnv: %s/%s/%s(%d) adding env var name=%s entry=%v", namespace, podName, name, i, envKeyStr, valueStr)
+	return changed
+}
 
-			if len(containers[i].Env) == 0 {
-				// need to create env array first
-				if !containerInitialized[i] {
-					list = append(list, fmt.Sprintf(`{"op":"add","path":"/spec/containers/%d/env","value":[]}`, i))
-					containerInitialized[i] = true
-				}
-			}
+// applyContainerEnv removes the env vars matching remove_env, except the
+// vars the entry sets, then adds the env vars and the envFrom sources.
+// An env var or envFrom source that already exists in the container is
+// handled by the on_conflict policy of the entry: skip (default) or overwrite.
+// It reports whether the container was changed.
+func applyContainerEnv(namespace, podName string, container podContainer,
+	c containerConfig) bool {
+
+	env := slices.Clone(container.Env)
+	envFrom := slices.Clone(container.EnvFrom)
+
+	keep := map[string]bool{}
+	for _, e := range c.Env {
+		if name, isStr := e["name"].(string); isStr {
+			keep[name] = true
+		}
+	}
+
+	removeEnvVars(namespace, podName, container, c.removeEnv, keep)
 
-			list = append(list, str)
+	for _, e := range c.Env {
+		addEnvVar(namespace, podName, container, e)
+	}
+
+	for _, e := range c.EnvFrom {
+		addEnvFrom(namespace, podName, container, e)
+	}
+
+	return !reflect.DeepEqual(env, container.Env) ||
+		!reflect.DeepEqual(envFrom, container.EnvFrom)
+}
+
+// removeEnvVars removes the env vars with name matching any of the
+// patterns, except the names to keep.
+func removeEnvVars(namespace, podName string, container podContainer,
+	patterns []*pattern, keep map[string]bool) {
+
+	if len(patterns) == 0 {
+		return
+	}
+
+	env := slices.DeleteFunc(slices.Clone(container.Env), func(e corev1.EnvVar) bool {
+		if keep[e.Name] {
+			return false
+		}
+		for _, p := range patterns {
+			if p.matchString(e.Name) {
+				log.Printf("addContainerEnv: %s/%s/%v removing env var name=%s",
+					namespace, podName, container, e.Name)
+				return true
+			}
 		}
+		return false
+	})
+
+	if len(env) == len(container.Env) {
+		return // nothing removed
+	}
+	if len(env) == 0 {
+		env = nil
+	}
+	container.Env = env
+}
+
+// addEnvVar adds the env entry to the container.
+func addEnvVar(namespace, podName string, container podContainer, env map[string]any) {
+	envKey := env["name"]
+	if envKey == nil {
+		log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container=%v missing env name", namespace, podName, container)
+		return
+	}
+	envKeyStr, isStr := envKey.(string)
+	if !isStr {
+		log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container=%v bad env name type: name='%v' type=%T", namespace, podName, container, envKey, envKey)
+		return
+	}
+	policy, _ := envPolicy(env) // checked by checkRulesOnConflict
+	envVar, errEnv := envVarFromConfig(env)
+	if errEnv != nil {
+		log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container=%v bad env: name='%s' error=%v value=%v", namespace, podName, container, envKeyStr, errEnv, env)
+		return
+	}
+
+	j := slices.IndexFunc(container.Env,
+		func(e corev1.EnvVar) bool { return e.Name == envKeyStr })
+
+	switch {
+	case j < 0:
+		log.Printf("addContainerEnv: %s/%s/%v adding env var name=%s entry=%v", namespace, podName, container, envKeyStr, env)
+		container.Env = append(container.Env, envVar)
+	case reflect.DeepEqual(container.Env[j], envVar):
+		// already set
+	case policy == onConflictOverwrite:
+		log.Printf("addContainerEnv: %s/%s/%v overwriting env var name=%s entry=%v", namespace, podName, container, envKeyStr, env)
+		container.Env[j] = envVar
+	default:
+		log.Printf("addContainerEnv: %s/%s/%v skipping existing env var name=%s", namespace, podName, container, envKeyStr)
+	}
+}
+
+// addEnvFrom adds the env_from entry to the container. A source already
+// referenced by the container, the same ConfigMap or Secret name, is a
+// conflict.
+func addEnvFrom(namespace, podName string, container podContainer, entry map[string]any) {
+	policy, _ := envPolicy(entry) // checked by checkRulesOnConflict
+	source, errSource := envFromConfig(entry)
+	if errSource != nil {
+		log.Printf("ERROR: addContainerEnv: ns=%s pod=%s container=%v bad env_from: error=%v value=%v", namespace, podName, container, errSource, entry)
+		return
 	}
 
-	return list
+	sourceName := envFromSourceName(source)
+
+	j := slices.IndexFunc(container.EnvFrom,
+		func(e corev1.EnvFromSource) bool { return envFromSourceName(e) == sourceName })
+
+	switch {
+	case j < 0:
+		log.Printf("addContainerEnv: %s/%s/%v adding env_from source=%s entry=%v", namespace, podName, container, sourceName, entry)
+		container.EnvFrom = append(container.EnvFrom, source)
+	case reflect.DeepEqual(container.EnvFrom[j], source):
+		// already set
+	case policy == onConflictOverwrite:
+		log.Printf("addContainerEnv: %s/%s/%v overwriting env_from source=%s entry=%v", namespace, podName, container, sourceName, entry)
+		container.EnvFrom[j] = source
+	default:
+		log.Printf("addContainerEnv: %s/%s/%v skipping existing env_from source=%s", namespace, podName, container, sourceName)
+	}
 }
 
-func addToleration(namespace, podName string, tol tolerationConfig) string {
-	log.Printf("addToleration: ns=%s pod=%s: %s", namespace, podName,
-		tolerationFieldsToString(tol.Key, tol.Operator, tol.Value, tol.Effect))
+// envVarFromConfig converts an env entry from the rules into an env var.
+func envVarFromConfig(env map[string]any) (corev1.EnvVar, error) {
+	var envVar corev1.EnvVar
+	errJSON := fromConfig(env, &envVar)
+	return envVar, errJSON
+}
 
-	return fmt.Sprintf(`{"op":"add","path":"/spec/tolerations/-","value":{"key":"%s","operator":"%s","effect":"%s","value":"%s"}}`,
-		tol.Key, tol.Operator, tol.Effect, tol.Value)
+// envFromConfig converts an env_from entry from the rules into an
+// envFrom source, referencing either a ConfigMap or a Secret.
+func envFromConfig(entry map[string]any) (corev1.EnvFromSource, error) {
+	var source corev1.EnvFromSource
+	if err := fromConfig(entry, &source); err != nil {
+		return source, err
+	}
+	if (source.ConfigMapRef == nil) == (source.SecretRef == nil) {
+		return source, fmt.Errorf("env_from requires either configMapRef or secretRef")
+	}
+	if envFromSourceName(source) == "" {
+		return source, fmt.Errorf("env_from requires the ConfigMap or Secret name")
+	}
+	return source, nil
 }
 
-func addNodeSelector(namespace, podName string, nodeSelector map[string]string) (string, error) {
+// envFromSourceName identifies the source referenced by envFrom.
+func envFromSourceName(source corev1.EnvFromSource) string {
+	switch {
+	case source.ConfigMapRef != nil && source.ConfigMapRef.Name != "":
+		return "configmap/" + source.ConfigMapRef.Name
+	case source.SecretRef != nil && source.SecretRef.Name != "":
+		return "secret/" + source.SecretRef.Name
+	}
+	return ""
+}
 
-	value, errJSON := labelsToJSONString(nodeSelector)
+// fromConfig converts an entry from the rules into the API type,
+// dropping on_conflict.
+func fromConfig(entry map[string]any, v any) error {
+	entry = maps.Clone(entry)
+	delete(entry, envOnConflict)
+	data, errJSON := json.Marshal(entry)
 	if errJSON != nil {
-		return "", fmt.Errorf("addNodeSelector: %v", errJSON)
+		return errJSON
+	}
+	return json.Unmarshal(data, v)
+}
+
+// addToleration adds the toleration, unless the pod already has it.
+// It reports whether the toleration was added.
+func addToleration(namespace, podName string, spec *corev1.PodSpec, tol tolerationConfig) bool {
+	t := corev1.Toleration{
+		Key:      tol.Key,
+		Operator: corev1.TolerationOperator(tol.Operator),
+		Effect:   corev1.TaintEffect(tol.Effect),
+		Value:    tol.Value,
 	}
 
-	log.Printf("addNodeSelector: ns=%s pod=%s: %s", namespace, podName, value)
+	str := tolerationFieldsToString(tol.Key, tol.Operator, tol.Value, tol.Effect)
 
-	return fmt.Sprintf(`{"op":"add","path":"/spec/nodeSelector","value":%s}`,
-		value), nil
+	for _, existing := range spec.Tolerations {
+		if existing.MatchToleration(&t) {
+			log.Printf("addToleration: ns=%s pod=%s: existing toleration skipped: %s",
+				namespace, podName, str)
+			return false
+		}
+	}
+
+	log.Printf("addToleration: ns=%s pod=%s: %s", namespace, podName, str)
+
+	spec.Tolerations = append(spec.Tolerations, t)
+
+	return true
 }
 
-func labelsToJSONString(v map[string]string) (string, error) {
-	data, errLabels := json.Marshal(v)
-	if errLabels != nil {
-		return "", fmt.Errorf("labelsToJSONString: input:%v error:%v", v, errLabels)
+// addNodeSelector merges the node selector into the pod node selector,
+// key by key, keeping the keys the pod already has. A key the pod already
+// has with a different value is handled by onConflict: overwrite (default)
+// or skip. It reports whether the node selector was changed.
+func addNodeSelector(namespace, podName string, spec *corev1.PodSpec,
+	nodeSelector map[string]string, onConflict string) bool {
+
+	if onConflict == "" {
+		onConflict = defaultNodeSelectorOnConflict
 	}
-	return string(data), nil
+
+	var changed bool
+
+	for _, k := range slices.Sorted(maps.Keys(nodeSelector)) {
+		v := nodeSelector[k]
+		old, found := spec.NodeSelector[k]
+		switch {
+		case found && old == v:
+			continue
+		case found && onConflict == onConflictSkip:
+			log.Printf("addNodeSelector: ns=%s pod=%s: existing key skipped: %s=%s (rule: %s)",
+				namespace, podName, k, old, v)
+			continue
+		case found:
+			log.Printf("addNodeSelector: ns=%s pod=%s: overwriting key: %s=%s (was: %s)",
+				namespace, podName, k, v, old)
+		default:
+			log.Printf("addNodeSelector: ns=%s pod=%s: adding key: %s=%s",
+				namespace, podName, k, v)
+		}
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[k] = v
+		changed = true
+	}
+
+	return changed
 }
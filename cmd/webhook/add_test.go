@@ -17,8 +17,11 @@ type placePodsTestCase struct {
 	priorityClassName string
 	priority          *int32
 	podLabels         string
+	podAnnotations    map[string]string
 	ownerReferences   []metav1.OwnerReference
 	containers        []corev1.Container
+	tolerations       []corev1.Toleration
+	nodeSelector      map[string]string
 	expected          string
 }
 
@@ -142,6 +145,34 @@ rules:
                     containerName: test-container
 `
 
+const placeRulesEnvConflict = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        test-container:
+            env:
+            - name: ENV1
+              value: VALUE1
+            - name: ENV2
+              value: VALUE2
+              on_conflict: overwrite
+`
+
+const placeRulesNodeSelectorSkip = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: spot
+        zone: b
+      node_selector_on_conflict: skip
+`
+
 const placePriorityClass = `
 rules:
 - place_pods:
@@ -178,6 +209,25 @@ rules:
       - namespace: ""
 `
 
+const placeAnnotations = `
+rules:
+- place_pods:
+  - pods:
+      - annotations:
+          karpenter.sh/do-not-disrupt: "true"
+    add:
+      node_selector:
+        nodepool: stable
+  - pods:
+      - and:
+        - annotations:
+            placement.example.com/pool: "regexp=^gpu-"
+        - namespace: ^ml$
+    add:
+      node_selector:
+        nodepool: gpu
+`
+
 var placePodsTestTable = []placePodsTestCase{
 	{
 		testName:  "empty rule",
@@ -209,7 +259,7 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace: "default",
 		podName:   "pod-1",
 		podLabels: ``,
-		expected:  `[{"op":"add","path":"/spec/tolerations/-","value":{"key":"key1","operator":"Equal","effect":"NoSchedule","value":"value1"}}]`,
+		expected:  `[{"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"key1","operator":"Equal","value":"value1"}]}]`,
 	},
 	{
 		testName:  "match all 3",
@@ -217,7 +267,7 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace: "default",
 		podName:   "pod-1",
 		podLabels: ``,
-		expected:  `[{"op":"add","path":"/spec/tolerations/-","value":{"key":"key1","operator":"Equal","effect":"NoSchedule","value":"value1"}} {"op":"add","path":"/spec/nodeSelector","value":{"node":"alpha"}}]`,
+		expected:  `[{"op":"add","path":"/spec/nodeSelector","value":{"node":"alpha"}} {"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"key1","operator":"Equal","value":"value1"}]}]`,
 	},
 	{
 		testName:  "match color label 1",
@@ -265,7 +315,7 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace: "default",
 		podName:   "pod-1",
 		podLabels: `{"batch.kubernetes.io/job-name":"anything"}`,
-		expected:  `[{"op":"add","path":"/spec/tolerations/-","value":{"key":"nodepool","operator":"Equal","effect":"NoSchedule","value":"job"}} {"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"job"}}]`,
+		expected:  `[{"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"job"}} {"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"nodepool","operator":"Equal","value":"job"}]}]`,
 	},
 	{
 		testName:  "not a job",
@@ -281,7 +331,7 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace: "default",
 		podName:   "pod-1",
 		podLabels: `{"batch.kubernetes.io/job-name":"test"}`,
-		expected:  `[{"op":"add","path":"/spec/tolerations/-","value":{"key":"nodepool","operator":"Equal","effect":"NoSchedule","value":"job"}} {"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"job"}}]`,
+		expected:  `[{"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"job"}} {"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"nodepool","operator":"Equal","value":"job"}]}]`,
 	},
 	{
 		testName:  "it is job with wrong label value",
@@ -299,7 +349,7 @@ var placePodsTestTable = []placePodsTestCase{
 		containers: []corev1.Container{
 			{Name: "test-container"},
 		},
-		expected: `[{"op":"add","path":"/spec/containers/0/env","value":[]} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"ENV1","value":"VALUE1"}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container"}}}}]`,
+		expected: `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"ENV1","value":"VALUE1"},{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}},{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container","divisor":"0","resource":""}}}]}]`,
 	},
 	{
 		testName:  "add env to container",
@@ -312,7 +362,7 @@ var placePodsTestTable = []placePodsTestCase{
 				Env:  []corev1.EnvVar{{Name: "KEY1", Value: "VAL1"}},
 			},
 		},
-		expected: `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"ENV1","value":"VALUE1"}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container"}}}}]`,
+		expected: `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"ENV1","value":"VALUE1"}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}} {"op":"add","path":"/spec/containers/0/env/-","value":{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container","divisor":"0","resource":""}}}}]`,
 	},
 	{
 		testName:  "add env to second container",
@@ -326,7 +376,104 @@ var placePodsTestTable = []placePodsTestCase{
 				Env:  []corev1.EnvVar{{Name: "KEY1", Value: "VAL1"}},
 			},
 		},
-		expected: `[{"op":"add","path":"/spec/containers/1/env/-","value":{"name":"ENV1","value":"VALUE1"}} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container"}}}}]`,
+		expected: `[{"op":"add","path":"/spec/containers/1/env/-","value":{"name":"ENV1","value":"VALUE1"}} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"MY_NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"MY_CPU_REQUEST","valueFrom":{"resourceFieldRef":{"containerName":"test-container","divisor":"0","resource":""}}}}]`,
+	},
+	{
+		testName:  "existing env is skipped by default",
+		rules:     placeRulesEnvConflict,
+		namespace: "default",
+		podName:   "pod-env-4",
+		containers: []corev1.Container{
+			{
+				Name: "test-container",
+				Env:  []corev1.EnvVar{{Name: "ENV1", Value: "OLD"}},
+			},
+		},
+		expected: `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"ENV2","value":"VALUE2"}}]`,
+	},
+	{
+		testName:  "existing env is overwritten",
+		rules:     placeRulesEnvConflict,
+		namespace: "default",
+		podName:   "pod-env-5",
+		containers: []corev1.Container{
+			{
+				Name: "test-container",
+				Env: []corev1.EnvVar{
+					{Name: "ENV2", Value: "OLD"},
+					{Name: "ENV1", Value: "VALUE1"},
+				},
+			},
+		},
+		expected: `[{"op":"replace","path":"/spec/containers/0/env/0/value","value":"VALUE2"}]`,
+	},
+	{
+		testName:  "reinvocation does not add env again",
+		rules:     placeRulesEnvConflict,
+		namespace: "default",
+		podName:   "pod-env-6",
+		containers: []corev1.Container{
+			{
+				Name: "test-container",
+				Env: []corev1.EnvVar{
+					{Name: "ENV1", Value: "VALUE1"},
+					{Name: "ENV2", Value: "VALUE2"},
+				},
+			},
+		},
+		expected: `[]`,
+	},
+	{
+		testName:  "existing toleration is skipped",
+		rules:     placeRulesMatchAll2,
+		namespace: "default",
+		podName:   "pod-1",
+		tolerations: []corev1.Toleration{
+			{Key: "key1", Operator: "Equal", Value: "value1", Effect: "NoSchedule"},
+		},
+		expected: `[]`,
+	},
+	{
+		testName:  "different toleration is added",
+		rules:     placeRulesMatchAll2,
+		namespace: "default",
+		podName:   "pod-1",
+		tolerations: []corev1.Toleration{
+			{Key: "key1", Operator: "Equal", Value: "other", Effect: "NoSchedule"},
+		},
+		expected: `[{"op":"add","path":"/spec/tolerations/-","value":{"effect":"NoSchedule","key":"key1","operator":"Equal","value":"value1"}}]`,
+	},
+	{
+		testName:     "node selector keys are merged",
+		rules:        placeRulesMatchAll1,
+		namespace:    "default",
+		podName:      "pod-1",
+		nodeSelector: map[string]string{"kubernetes.io/os": "linux"},
+		expected:     `[{"op":"add","path":"/spec/nodeSelector/node","value":"alpha"}]`,
+	},
+	{
+		testName:     "node selector key is overwritten by default",
+		rules:        placeRulesMatchAll1,
+		namespace:    "default",
+		podName:      "pod-1",
+		nodeSelector: map[string]string{"kubernetes.io/os": "linux", "node": "beta"},
+		expected:     `[{"op":"replace","path":"/spec/nodeSelector/node","value":"alpha"}]`,
+	},
+	{
+		testName:     "node selector key conflict is skipped",
+		rules:        placeRulesNodeSelectorSkip,
+		namespace:    "default",
+		podName:      "pod-1",
+		nodeSelector: map[string]string{"pool": "stable"},
+		expected:     `[{"op":"add","path":"/spec/nodeSelector/zone","value":"b"}]`,
+	},
+	{
+		testName:     "node selector already set",
+		rules:        placeRulesNodeSelectorSkip,
+		namespace:    "default",
+		podName:      "pod-1",
+		nodeSelector: map[string]string{"pool": "spot", "zone": "b"},
+		expected:     `[]`,
 	},
 	{
 		testName:  "add env to non-existing container",
@@ -361,7 +508,7 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace:         "default",
 		podName:           "pod-1",
 		priorityClassName: "other",
-		expected:          `[{"op":"add","path":"/spec/priorityClassName","value":"low"}]`,
+		expected:          `[{"op":"replace","path":"/spec/priorityClassName","value":"low"}]`,
 	},
 	{
 		testName:          "existing priority should be removed",
@@ -370,7 +517,7 @@ var placePodsTestTable = []placePodsTestCase{
 		podName:           "pod-1",
 		priorityClassName: "other",
 		priority:          &priority,
-		expected:          `[{"op":"add","path":"/spec/priorityClassName","value":"low"} {"op":"remove","path":"/spec/priority"}]`,
+		expected:          `[{"op":"remove","path":"/spec/priority"} {"op":"replace","path":"/spec/priorityClassName","value":"low"}]`,
 	},
 	{
 		testName:          "multirule place",
@@ -378,10 +525,126 @@ var placePodsTestTable = []placePodsTestCase{
 		namespace:         "default",
 		podName:           "pod-1",
 		priorityClassName: "other",
-		expected:          `[{"op":"add","path":"/spec/priorityClassName","value":"low"} {"op":"add","path":"/spec/nodeSelector","value":{"node":"alpha"}}]`,
+		// placements from both rule groups are merged into a single placement
+		expected: `[{"op":"add","path":"/spec/nodeSelector","value":{"node":"alpha"}} {"op":"replace","path":"/spec/priorityClassName","value":"low"}]`,
+	},
+	{
+		testName:       "match exact annotation",
+		rules:          placeAnnotations,
+		namespace:      "default",
+		podName:        "pod-1",
+		podAnnotations: map[string]string{"karpenter.sh/do-not-disrupt": "true"},
+		expected:       `[{"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"stable"}}]`,
+	},
+	{
+		testName:       "mismatch exact annotation",
+		rules:          placeAnnotations,
+		namespace:      "default",
+		podName:        "pod-1",
+		podAnnotations: map[string]string{"karpenter.sh/do-not-disrupt": "false"},
+		expected:       `[]`,
+	},
+	{
+		testName:       "match regexp annotation within and",
+		rules:          placeAnnotations,
+		namespace:      "ml",
+		podName:        "pod-1",
+		podAnnotations: map[string]string{"placement.example.com/pool": "gpu-a100"},
+		expected:       `[{"op":"add","path":"/spec/nodeSelector","value":{"nodepool":"gpu"}}]`,
+	},
+	{
+		testName:       "mismatch regexp annotation within and",
+		rules:          placeAnnotations,
+		namespace:      "default",
+		podName:        "pod-1",
+		podAnnotations: map[string]string{"placement.example.com/pool": "gpu-a100"},
+		expected:       `[]`,
+	},
+	{
+		testName:  "strategy first applies only first match",
+		rules:     placeRulesStrategyFirst,
+		namespace: "default",
+		podName:   "pod-1",
+		expected:  `[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"spot"}} {"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"spot","operator":"Exists"}]}]`,
+	},
+	{
+		testName:  "strategy merge applies all matches",
+		rules:     placeRulesStrategyMerge,
+		namespace: "default",
+		podName:   "pod-1",
+		containers: []corev1.Container{
+			{Name: "app", Env: []corev1.EnvVar{{Name: "A", Value: "a"}}},
+		},
+		expected: `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"OTEL_ENDPOINT","value":"otel:4317"}} {"op":"add","path":"/spec/nodeSelector","value":{"pool":"spot","zone":"b"}} {"op":"add","path":"/spec/priorityClassName","value":"high"} {"op":"add","path":"/spec/tolerations","value":[{"effect":"NoSchedule","key":"spot","operator":"Exists"}]}]`,
+	},
+	{
+		testName:  "strategy merge with single match",
+		rules:     placeRulesStrategyMerge,
+		namespace: "kube-system",
+		podName:   "pod-1",
+		expected:  `[{"op":"add","path":"/spec/nodeSelector","value":{"zone":"a"}} {"op":"add","path":"/spec/priorityClassName","value":"low"}]`,
 	},
 }
 
+const placeRulesStrategyFirst = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ^default$
+    add:
+      tolerations:
+        - key: spot
+          operator: Exists
+          effect: NoSchedule
+      node_selector:
+        pool: spot
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        zone: a
+`
+
+const placeRulesStrategyMerge = `
+rules:
+- strategy: merge
+  place_pods:
+  - rule_name: spot
+    pods:
+      - namespace: ^default$
+    add:
+      tolerations:
+        - key: spot
+          operator: Exists
+          effect: NoSchedule
+      node_selector:
+        pool: spot
+        zone: a
+  - rule_name: defaults
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        zone: a
+      priority_class_name: low
+  - rule_name: observability
+    pods:
+      - namespace: ^default$
+    add:
+      tolerations:
+        - key: spot
+          operator: Exists
+          effect: NoSchedule
+      node_selector:
+        zone: b
+      priority_class_name: high
+      containers:
+        app:
+          env:
+            - name: OTEL_ENDPOINT
+              value: otel:4317
+`
+
 var priority int32 = 500
 
 // go test -count 1 -run '^TestPlacePods$' ./cmd/webhook
@@ -413,15 +676,26 @@ func TestPlacePods(t *testing.T) {
 			}
 		}
 
-		var list []string
-
-		for _, r := range ruleList.Rules {
-			list = append(list, addPlacement(data.namespace, data.podName,
-				data.priorityClassName, data.priority, podLabels,
-				data.ownerReferences, data.containers, r.PlacePods)...)
+		info := podInfo{
+			namespace:         data.namespace,
+			name:              data.podName,
+			priorityClassName: data.priorityClassName,
+			labels:            podLabels,
+			annotations:       data.podAnnotations,
+			ownerReferences:   data.ownerReferences,
+			containers:        data.containers,
 		}
+		pod := corev1.Pod{Spec: corev1.PodSpec{
+			PriorityClassName: data.priorityClassName,
+			Priority:          data.priority,
+			Containers:        data.containers,
+			Tolerations:       data.tolerations,
+			NodeSelector:      data.nodeSelector,
+		}}
+		mutated := pod.DeepCopy()
+		addPlacement(info, &mutated.Spec, ruleList.ordered.PlacePods)
 
-		result := fmt.Sprintf("%v", list)
+		result := diffString(t, &pod, mutated)
 
 		if result != data.expected {
 			t.Errorf("%s\n==      got:'%s'\n== expected:'%s'",
@@ -429,3 +703,309 @@ func TestPlacePods(t *testing.T) {
 		}
 	}
 }
+
+// go test -count 1 -run '^TestPlacePodsBadStrategy$' ./cmd/webhook
+func TestPlacePodsBadStrategy(t *testing.T) {
+	const input = `
+rules:
+- strategy: all
+  place_pods:
+  - add:
+      node_selector:
+        node: alpha
+`
+	if _, err := newRules([]byte(input), false); err == nil {
+		t.Errorf("expected error for bad strategy, got nil")
+	}
+}
+
+// go test -count 1 -run '^TestPlacePodsBadEnvOnConflict$' ./cmd/webhook
+func TestPlacePodsBadEnvOnConflict(t *testing.T) {
+	const input = `
+rules:
+- place_pods:
+  - add:
+      containers:
+        app:
+          env:
+          - name: ENV1
+            value: VALUE1
+            on_conflict: append
+`
+	if _, err := newRules([]byte(input), false); err == nil {
+		t.Errorf("expected error for bad on_conflict, got nil")
+	}
+}
+
+// go test -count 1 -run '^TestPlacePodsBadNodeSelectorOnConflict$' ./cmd/webhook
+func TestPlacePodsBadNodeSelectorOnConflict(t *testing.T) {
+	const input = `
+rules:
+- place_pods:
+  - add:
+      node_selector:
+        node: alpha
+      node_selector_on_conflict: replace
+`
+	if _, err := newRules([]byte(input), false); err == nil {
+		t.Errorf("expected error for bad node_selector_on_conflict, got nil")
+	}
+}
+
+var containerEnvTestTable = []podRuleTestCase{
+	{
+		name: "env_from for container without envFrom",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+          env_from:
+          - configMapRef:
+              name: proxy-settings
+          - secretRef:
+              name: db
+            prefix: DB_
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/envFrom","value":[{"configMapRef":{"name":"proxy-settings"}},{"prefix":"DB_","secretRef":{"name":"db"}}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "env_from existing source is skipped",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          env_from:
+          - configMapRef:
+              name: shared
+            prefix: B_
+          - secretRef:
+              name: shared
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/envFrom/-","value":{"secretRef":{"name":"shared"}}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "env_from existing source is overwritten",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          env_from:
+          - configMapRef:
+              name: shared
+            prefix: B_
+            on_conflict: overwrite
+`,
+		expected:    `[{"op":"replace","path":"/spec/containers/1/envFrom/0/prefix","value":"B_"}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "remove_env by name pattern",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        "*":
+          remove_env:
+          - (?i)^https?_proxy$
+`,
+		expected:    `[{"op":"remove","path":"/spec/containers/1/env/2"} {"op":"remove","path":"/spec/containers/1/env/1"}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "remove_env of all vars removes env",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          remove_env:
+          - ""
+`,
+		expected:    `[{"op":"remove","path":"/spec/containers/1/env"}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "remove_env keeps the vars the entry sets",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          remove_env:
+          - (?i)_proxy$
+          env:
+          - name: HTTP_PROXY
+            value: proxy:8080
+            on_conflict: overwrite
+`,
+		expected:    `[{"op":"remove","path":"/spec/containers/1/env/2"} {"op":"remove","path":"/spec/containers/1/env/1"} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"HTTP_PROXY","value":"proxy:8080"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "remove_env then add is not a change",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          remove_env:
+          - ^HTTP_PROXY$
+          env:
+          - name: HTTP_PROXY
+            value: proxy:3128
+`,
+		expected:    `[]`,
+		expectFired: `[]`,
+	},
+	{
+		name: "container on_conflict overwrites existing var",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          on_conflict: overwrite
+          env:
+          - name: ENV1
+            value: NEW
+          - name: https_proxy
+            value: proxy:3128
+            on_conflict: skip
+`,
+		expected:    `[{"op":"replace","path":"/spec/containers/1/env/0/value","value":"NEW"}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "merged placements keep container on_conflict",
+		rules: `
+rules:
+- strategy: merge
+  place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          on_conflict: overwrite
+          env:
+          - name: ENV1
+            value: NEW
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        worker:
+          env:
+          - name: ENV1
+            value: OTHER
+`,
+		expected:    `[{"op":"replace","path":"/spec/containers/1/env/0/value","value":"NEW"}]`,
+		expectFired: `[rules[0].place_pods[0] rules[0].place_pods[1]]`,
+	},
+}
+
+// go test -count 1 -run '^TestContainerEnv$' ./cmd/webhook
+func TestContainerEnv(t *testing.T) {
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app"},
+				{
+					Name: "worker",
+					Env: []corev1.EnvVar{
+						{Name: "ENV1", Value: "OLD"},
+						{Name: "HTTP_PROXY", Value: "proxy:3128"},
+						{Name: "https_proxy", Value: "proxy:3128"},
+					},
+					EnvFrom: []corev1.EnvFromSource{{
+						Prefix: "A_",
+						ConfigMapRef: &corev1.ConfigMapEnvSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "shared"},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	runPodRuleCases(t, pod, containerEnvTestTable,
+		func(info podInfo, spec *corev1.PodSpec, ordered rulesConfig) []string {
+			return addPlacement(info, spec, ordered.PlacePods)
+		})
+}
+
+// go test -count 1 -run '^TestContainerEnvBad$' ./cmd/webhook
+func TestContainerEnvBad(t *testing.T) {
+	const rules = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+%s
+`
+	inputs := []string{
+		`
+          env_from:
+          - prefix: X_`,
+		`
+          env_from:
+          - configMapRef:
+              name: a
+            secretRef:
+              name: b`,
+		`
+          env_from:
+          - secretRef:
+              optional: true`,
+		`
+          remove_env:
+          - ^HTTP_PROXY(`,
+		`
+          on_conflict: append`,
+		`
+          env_from:
+          - secretRef:
+              name: db
+            on_conflict: append`,
+	}
+	for i, input := range inputs {
+		if _, err := newRules(fmt.Appendf(nil, rules, input), true); err == nil {
+			t.Errorf("%d of %d: expected error for bad container env, got nil",
+				i+1, len(inputs))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// removeNodeAffinity removes the restricted expressions from the node
+// affinity terms of the pod spec, both required and preferred, looking
+// at matchExpressions and matchFields. Like tolerations, an expression
+// is removed by the first rule that matches it and does not allow the
+// pod, unless a final rule allowing the pod comes first.
+//
+// A term left without expressions is dropped, since an empty term
+// matches no node. Then empty affinity sections are dropped as well.
+// It returns the rules that removed expressions.
+func removeNodeAffinity(pod podInfo, spec *corev1.PodSpec,
+	restrictNodeAffinity []restrictNodeAffinityConfig) []string {
+
+	if len(restrictNodeAffinity) == 0 || spec.Affinity == nil ||
+		spec.Affinity.NodeAffinity == nil {
+		return nil
+	}
+
+	na := spec.Affinity.NodeAffinity
+
+	var fired []string // rules that removed expressions
+
+	if required := na.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+		var terms []corev1.NodeSelectorTerm
+		for i, term := range required.NodeSelectorTerms {
+			where := fmt.Sprintf("required[%d]", i)
+			term, empty := restrictNodeSelectorTerm(pod, where, term,
+				restrictNodeAffinity, &fired)
+			if empty {
+				log.Printf("pod: %s/%s: nodeAffinity: %s: empty term dropped",
+					pod.namespace, pod.name, where)
+				continue
+			}
+			terms = append(terms, term)
+		}
+		required.NodeSelectorTerms = terms
+		if len(terms) == 0 {
+			na.RequiredDuringSchedulingIgnoredDuringExecution = nil
+		}
+	}
+
+	var preferred []corev1.PreferredSchedulingTerm
+	for i, p := range na.PreferredDuringSchedulingIgnoredDuringExecution {
+		where := fmt.Sprintf("preferred[%d]", i)
+		term, empty := restrictNodeSelectorTerm(pod, where, p.Preference,
+			restrictNodeAffinity, &fired)
+		if empty {
+			log.Printf("pod: %s/%s: nodeAffinity: %s: empty term dropped",
+				pod.namespace, pod.name, where)
+			continue
+		}
+		p.Preference = term
+		preferred = append(preferred, p)
+	}
+	na.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+
+	if len(fired) > 0 && na.RequiredDuringSchedulingIgnoredDuringExecution == nil &&
+		len(na.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+		spec.Affinity.NodeAffinity = nil
+		if spec.Affinity.PodAffinity == nil && spec.Affinity.PodAntiAffinity == nil {
+			spec.Affinity = nil
+		}
+	}
+
+	return fired
+}
+
+// restrictNodeSelectorTerm removes the restricted expressions from the term.
+// It reports whether the term was left empty by the removal.
+func restrictNodeSelectorTerm(pod podInfo, where string, term corev1.NodeSelectorTerm,
+	restrictNodeAffinity []restrictNodeAffinityConfig,
+	fired *[]string) (corev1.NodeSelectorTerm, bool) {
+
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return term, false // keep terms that were already empty
+	}
+
+	term.MatchExpressions = restrictNodeSelectorRequirements(pod,
+		where+".matchExpressions", term.MatchExpressions, restrictNodeAffinity, fired)
+	term.MatchFields = restrictNodeSelectorRequirements(pod,
+		where+".matchFields", term.MatchFields, restrictNodeAffinity, fired)
+
+	return term, len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0
+}
+
+// restrictNodeSelectorRequirements returns the requirements the pod is allowed to have.
+func restrictNodeSelectorRequirements(pod podInfo, where string,
+	requirements []corev1.NodeSelectorRequirement,
+	restrictNodeAffinity []restrictNodeAffinityConfig,
+	fired *[]string) []corev1.NodeSelectorRequirement {
+
+	var kept []corev1.NodeSelectorRequirement
+
+	for i, req := range requirements {
+
+		var removed bool
+		track := "[no node affinity rule matched]"
+
+		for j, ra := range restrictNodeAffinity {
+
+			if isRestricted := ra.Expression.match(req); !isRestricted {
+				continue // this rule does not restrict the expression
+			}
+
+			podRule := slices.IndexFunc(ra.AllowedPods,
+				func(allowedPod podConfig) bool { return allowedPod.match(pod) })
+
+			if podRule < 0 {
+				// pod is not allowed to have the expression
+				removed = true
+				track = fmt.Sprintf("[nodeAffinityRule=%d/%d rule=%s]",
+					j, len(restrictNodeAffinity), ra.id)
+				*fired = addFired(*fired, ra.id)
+				break
+			}
+
+			track = fmt.Sprintf("[nodeAffinityRule=%d/%d podRule=%d/%d]",
+				j, len(restrictNodeAffinity), podRule, len(ra.AllowedPods))
+
+			if ra.Final {
+				// pod allowed by final rule, skip remaining rules
+				track += " [final]"
+				break
+			}
+		}
+
+		log.Printf("pod: %s/%s: nodeAffinity: %s[%d]: key(%s) op(%s) values%v: removed=%t %s",
+			pod.namespace, pod.name, where, i, req.Key, req.Operator, req.Values,
+			removed, track)
+
+		if !removed {
+			kept = append(kept, req)
+		}
+	}
+
+	return kept
+}
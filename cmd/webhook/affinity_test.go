@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const nodeAffinityRules = `
+rules:
+- restrict_node_affinity:
+  - rule_name: gpu-only-for-ml
+    expression:
+      key: ^accelerator$
+    allowed_pods:
+      - namespace: ^ml$
+  - rule_name: no-spot
+    expression:
+      key: ^pool$
+      operator: ^In$
+      value: ^spot$
+  - rule_name: no-node-name
+    expression:
+      key: ^metadata.name$
+`
+
+type nodeAffinityTestCase struct {
+	name      string
+	namespace string
+	affinity  *corev1.Affinity
+	expected  string
+}
+
+func nodeRequirement(key string, op corev1.NodeSelectorOperator,
+	values ...string) corev1.NodeSelectorRequirement {
+	return corev1.NodeSelectorRequirement{Key: key, Operator: op, Values: values}
+}
+
+func requiredAffinity(terms ...corev1.NodeSelectorTerm) *corev1.Affinity {
+	return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: terms,
+		},
+	}}
+}
+
+var nodeAffinityTestTable = []nodeAffinityTestCase{
+	{
+		name:      "no affinity",
+		namespace: "default",
+		expected:  `[] []`,
+	},
+	{
+		name:      "unrestricted expressions",
+		namespace: "default",
+		affinity: requiredAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			nodeRequirement("pool", "In", "stable"),
+			nodeRequirement("zone", "Exists"),
+		}}),
+		expected: `[] []`,
+	},
+	{
+		name:      "restricted expression removed",
+		namespace: "default",
+		affinity: requiredAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			nodeRequirement("accelerator", "Exists"),
+			nodeRequirement("zone", "In", "a"),
+		}}),
+		expected: `[{"op":"remove","path":"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0/matchExpressions/0"}] [gpu-only-for-ml]`,
+	},
+	{
+		name:      "allowed pod keeps expression",
+		namespace: "ml",
+		affinity: requiredAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			nodeRequirement("accelerator", "Exists"),
+		}}),
+		expected: `[] []`,
+	},
+	{
+		name:      "value matches any of the values",
+		namespace: "default",
+		affinity: requiredAffinity(
+			corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+				nodeRequirement("pool", "In", "stable", "spot"),
+			}},
+			corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+				nodeRequirement("pool", "NotIn", "spot"),
+			}},
+		),
+		expected: `[{"op":"remove","path":"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0"}] [no-spot]`,
+	},
+	{
+		name:      "match fields",
+		namespace: "default",
+		affinity: requiredAffinity(corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{nodeRequirement("zone", "In", "a")},
+			MatchFields:      []corev1.NodeSelectorRequirement{nodeRequirement("metadata.name", "In", "node-1")},
+		}),
+		expected: `[{"op":"remove","path":"/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0/matchFields"}] [no-node-name]`,
+	},
+	{
+		name:      "empty node affinity dropped",
+		namespace: "default",
+		affinity: requiredAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			nodeRequirement("accelerator", "Exists"),
+		}}),
+		expected: `[{"op":"remove","path":"/spec/affinity"}] [gpu-only-for-ml]`,
+	},
+	{
+		name:      "pod affinity kept",
+		namespace: "default",
+		affinity: &corev1.Affinity{
+			NodeAffinity: requiredAffinity(corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+				nodeRequirement("accelerator", "Exists"),
+			}}).NodeAffinity,
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+					{TopologyKey: "kubernetes.io/hostname"},
+				},
+			},
+		},
+		expected: `[{"op":"remove","path":"/spec/affinity/nodeAffinity"}] [gpu-only-for-ml]`,
+	},
+	{
+		name:      "empty preferred term dropped",
+		namespace: "default",
+		affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+				{Weight: 10, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+					nodeRequirement("pool", "In", "spot"),
+				}}},
+				{Weight: 20, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+					nodeRequirement("zone", "In", "a"),
+				}}},
+			},
+		}},
+		expected: `[{"op":"remove","path":"/spec/affinity/nodeAffinity/preferredDuringSchedulingIgnoredDuringExecution/0"}] [no-spot]`,
+	},
+}
+
+// go test -count 1 -run '^TestRestrictNodeAffinity$' ./cmd/webhook
+func TestRestrictNodeAffinity(t *testing.T) {
+
+	list, errRules := newRules([]byte(nodeAffinityRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	for i, data := range nodeAffinityTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(nodeAffinityTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{Spec: corev1.PodSpec{Affinity: data.affinity}}
+			mutated := pod.DeepCopy()
+			fired := removeNodeAffinity(podInfo{namespace: data.namespace, name: "pod-1"},
+				&mutated.Spec, list.ordered.RestrictNodeAffinity)
+
+			if got := diffString(t, &pod, mutated) + fmt.Sprintf(" %v", fired); got != data.expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, data.expected)
+			}
+		})
+	}
+}
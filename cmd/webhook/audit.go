@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// Rule modes.
+// In audit mode the rule patch is computed, logged and reported as an
+// audit annotation, but it is not applied.
+const (
+	modeEnforce = "enforce"
+	modeAudit   = "audit"
+)
+
+// auditAnnotationKey is prefixed by the api-server with the webhook name.
+const auditAnnotationKey = "audit-patch"
+
+func checkMode(mode string) error {
+	switch mode {
+	case "", modeEnforce, modeAudit:
+		return nil
+	}
+	return fmt.Errorf("bad rule mode: '%s' (expecting %s or %s)",
+		mode, modeEnforce, modeAudit)
+}
+
+func checkRulesMode(r rulesConfig) error {
+	for _, i := range r.RestrictTolerations {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.RestrictNodeSelectors {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.RestrictNodeAffinity {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.PlacePods {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.Resources {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.DisableDaemonsets {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.NamespacesAddLabels {
+		if err := checkMode(i.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitMode separates items in enforce mode from items in audit mode.
+// If dryRun is true, all items are in audit mode.
+func splitMode[T any](items []T, mode func(T) string, dryRun bool) ([]T, []T) {
+	if dryRun {
+		return nil, items
+	}
+	var enforce, audit []T
+	for _, item := range items {
+		if mode(item) == modeAudit {
+			audit = append(audit, item)
+			continue
+		}
+		enforce = append(enforce, item)
+	}
+	return enforce, audit
+}
+
+// splitMode separates rules in enforce mode from rules in audit mode.
+func (r rulesConfig) splitMode(dryRun bool) (rulesConfig, rulesConfig) {
+	enforce := rulesConfig{Strategy: r.Strategy}
+	audit := rulesConfig{Strategy: r.Strategy}
+
+	enforce.RestrictTolerations, audit.RestrictTolerations = splitMode(r.RestrictTolerations,
+		func(i restrictTolerationConfig) string { return i.Mode }, dryRun)
+
+	enforce.RestrictNodeSelectors, audit.RestrictNodeSelectors = splitMode(r.RestrictNodeSelectors,
+		func(i restrictNodeSelectorConfig) string { return i.Mode }, dryRun)
+
+	enforce.RestrictNodeAffinity, audit.RestrictNodeAffinity = splitMode(r.RestrictNodeAffinity,
+		func(i restrictNodeAffinityConfig) string { return i.Mode }, dryRun)
+
+	enforce.PlacePods, audit.PlacePods = splitMode(r.PlacePods,
+		func(i placementConfig) string { return i.Mode }, dryRun)
+
+	enforce.Resources, audit.Resources = splitMode(r.Resources,
+		func(i setResource) string { return i.Mode }, dryRun)
+
+	enforce.DisableDaemonsets, audit.DisableDaemonsets = splitMode(r.DisableDaemonsets,
+		func(i selectDaemonset) string { return i.Mode }, dryRun)
+
+	enforce.NamespacesAddLabels, audit.NamespacesAddLabels = splitMode(r.NamespacesAddLabels,
+		func(i nsAddLabels) string { return i.Mode }, dryRun)
+
+	return enforce, audit
+}
+
+// keepFired keeps the fired rules that are items of the rules section.
+// Audit mode rules are evaluated along with the enforce mode rules,
+// so that an audit rule beaten by an enforce rule (strategy first,
+// final, priority) is not reported, and keepFired picks the audit
+// rules among the fired ones.
+func (r rulesConfig) keepFired(fired []string) []string {
+	ids := r.ids()
+	var list []string
+	for _, id := range fired {
+		if slices.Contains(ids, id) {
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+// empty reports whether the rules section has no rule items.
+func (r rulesConfig) empty() bool {
+	return len(r.RestrictTolerations) == 0 && len(r.RestrictNodeSelectors) == 0 &&
+		len(r.RestrictNodeAffinity) == 0 && len(r.PlacePods) == 0 &&
+		len(r.Resources) == 0 && len(r.DisableDaemonsets) == 0 &&
+		len(r.NamespacesAddLabels) == 0
+}
+
+// auditRecord is logged as one JSON line for every request
+// that audit mode rules would have changed.
+type auditRecord struct {
+	Audit     string          `json:"audit"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Operation string          `json:"operation"`
+	UID       string          `json:"uid"`
+	Rules     []string        `json:"rules"`
+	Patch     json.RawMessage `json:"patch"`
+}
+
+// setAudit logs the patch from the original object to the one changed
+// by rules in audit mode, and attaches it to the response
+// as an audit annotation.
+// The original is the object changed by the enforce mode rules, and the
+// mutated one is changed by all rules, so the patch is the change the
+// audit rules would add if enforced. With DRY_RUN, that is the whole patch.
+func setAudit(admissionResponse *admissionv1.AdmissionResponse,
+	request *admissionv1.AdmissionRequest, name string,
+	original, mutated any, auditFired []string) {
+
+	// the audit patch applies after the patch of the enforce mode rules
+	auditRequest := *request // shallow copy, only the object is replaced
+	if len(admissionResponse.Patch) > 0 {
+		enforced, errEnforced := applyPatch(request.Object.Raw, admissionResponse.Patch)
+		if errEnforced != nil {
+			log.Printf("ERROR: setAudit: %s/%s: %v", request.Namespace, name, errEnforced)
+			return
+		}
+		auditRequest.Object.Raw = enforced
+	}
+
+	data, errPatch := objectPatch(&auditRequest, original, mutated)
+	if errPatch != nil {
+		log.Printf("ERROR: setAudit: %s/%s: %v", request.Namespace, name, errPatch)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	patch := string(data)
+
+	rec := auditRecord{
+		Audit:     "would-patch",
+		Kind:      request.Kind.Kind,
+		Namespace: request.Namespace,
+		Name:      name,
+		Operation: string(request.Operation),
+		UID:       string(request.UID),
+		Rules:     auditFired,
+		Patch:     json.RawMessage(patch),
+	}
+
+	data, errJSON := json.Marshal(rec)
+	if errJSON != nil {
+		log.Printf("ERROR: setAudit: %s/%s: bad audit patch: %v: %s",
+			request.Namespace, name, errJSON, patch)
+		return
+	}
+
+	log.Printf("audit: %s", string(data))
+
+	if admissionResponse.AuditAnnotations == nil {
+		admissionResponse.AuditAnnotations = map[string]string{}
+	}
+	admissionResponse.AuditAnnotations[auditAnnotationKey] = patch
+}
+
+// applyPatch applies the JSON patch to the object.
+func applyPatch(object, patch []byte) ([]byte, error) {
+	p, errDecode := jsonpatch.DecodePatch(patch)
+	if errDecode != nil {
+		return nil, fmt.Errorf("decode patch: %v", errDecode)
+	}
+	result, errApply := p.Apply(object)
+	if errApply != nil {
+		return nil, fmt.Errorf("apply patch: %v", errApply)
+	}
+	return result, nil
+}
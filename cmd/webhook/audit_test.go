@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+const auditRules = `
+rules:
+- place_pods:
+  - mode: audit
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        node: audit
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        node: enforce
+- namespaces_add_labels:
+  - mode: enforce
+    name: ""
+    add_labels:
+      a: b
+`
+
+// go test -count 1 -run '^TestAuditSplitMode$' ./cmd/webhook
+func TestAuditSplitMode(t *testing.T) {
+
+	list, errRules := newRules([]byte(auditRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	enforce, audit := list.Rules[0].splitMode(false)
+
+	if len(enforce.PlacePods) != 1 || enforce.PlacePods[0].Add.NodeSelector["node"] != "enforce" {
+		t.Errorf("enforce: wrong place_pods: %v", enforce.PlacePods)
+	}
+	if len(audit.PlacePods) != 1 || audit.PlacePods[0].Add.NodeSelector["node"] != "audit" {
+		t.Errorf("audit: wrong place_pods: %v", audit.PlacePods)
+	}
+
+	enforce2, audit2 := list.Rules[1].splitMode(false)
+	if len(enforce2.NamespacesAddLabels) != 1 || !audit2.empty() {
+		t.Errorf("explicit enforce mode: enforce=%v audit=%v", enforce2, audit2)
+	}
+
+	// dry run puts everything in audit mode
+	enforce3, audit3 := list.Rules[0].splitMode(true)
+	if !enforce3.empty() || len(audit3.PlacePods) != 2 {
+		t.Errorf("dry run: enforce=%v audit=%v", enforce3, audit3)
+	}
+}
+
+// go test -count 1 -run '^TestAuditBadMode$' ./cmd/webhook
+func TestAuditBadMode(t *testing.T) {
+	const input = `
+rules:
+- resources:
+  - mode: audti
+    container: ""
+`
+	if _, err := newRules([]byte(input), false); err == nil {
+		t.Errorf("expected error for bad mode, got nil")
+	}
+}
+
+// go test -count 1 -run '^TestSetAudit$' ./cmd/webhook
+func TestSetAudit(t *testing.T) {
+
+	request := &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: []byte(`{"spec":{}}`)},
+	}
+
+	resp := &admissionv1.AdmissionResponse{}
+
+	pod := &corev1.Pod{}
+
+	setAudit(resp, request, "pod-1", pod, pod.DeepCopy(), nil)
+	if resp.AuditAnnotations != nil {
+		t.Errorf("no change: unexpected annotations: %v", resp.AuditAnnotations)
+	}
+
+	mutated := pod.DeepCopy()
+	mutated.Spec.NodeSelector = map[string]string{"node": "audit"}
+	setAudit(resp, request, "pod-1", pod, mutated, []string{"rules[0].place_pods[0]"})
+
+	const expected = `[{"op":"add","path":"/spec/nodeSelector","value":{"node":"audit"}}]`
+	if got := resp.AuditAnnotations[auditAnnotationKey]; got != expected {
+		t.Errorf("got=%s expected=%s", got, expected)
+	}
+
+	if resp.Patch != nil {
+		t.Errorf("audit must not set patch: %s", string(resp.Patch))
+	}
+}
+
+type auditPodTestCase struct {
+	name          string
+	rules         string
+	dryRun        bool
+	expectedPatch string
+	expectedAudit string
+}
+
+var auditPodTestTable = []auditPodTestCase{
+	{
+		name: "audit item beaten by enforce item is not reported",
+		rules: `
+rules:
+- place_pods:
+  - rule_name: b
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: b
+  - rule_name: a
+    mode: audit
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: a
+`,
+		expectedPatch: `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"b","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"add","path":"/spec/nodeSelector","value":{"pool":"b"}}]`,
+		expectedAudit: ``,
+	},
+	{
+		name: "audit item beating enforce item reports the change to the enforced pod",
+		rules: `
+rules:
+- place_pods:
+  - rule_name: a
+    mode: audit
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: a
+  - rule_name: b
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: b
+`,
+		expectedPatch: `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"b","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"add","path":"/spec/nodeSelector","value":{"pool":"b"}}]`,
+		expectedAudit: `[{"op":"replace","path":"/spec/nodeSelector/pool","value":"a"}]`,
+	},
+	{
+		name: "dry run reports the enforced patch",
+		rules: `
+rules:
+- place_pods:
+  - rule_name: b
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: b
+  - rule_name: a
+    mode: audit
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: a
+`,
+		dryRun:        true,
+		expectedPatch: ``,
+		expectedAudit: `[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"b"}}]`,
+	},
+}
+
+// go test -count 1 -run '^TestAuditPod$' ./cmd/webhook
+func TestAuditPod(t *testing.T) {
+
+	const pod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"pod-1","namespace":"default"},"spec":{"containers":[{"name":"app"}]}}`
+
+	for i, data := range auditPodTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(auditPodTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			store := &rulesStore{}
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			if err := os.WriteFile(path, []byte(data.rules), 0o600); err != nil {
+				t.Fatalf("write rules: %v", err)
+			}
+			if _, err := store.reload(path, true); err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+
+			app := &application{
+				codecs: serializer.NewCodecFactory(runtime.NewScheme()),
+				rules:  store,
+			}
+			app.conf.dryRun = data.dryRun
+
+			resp := admissionResponse(t, app, &admissionv1.AdmissionRequest{
+				UID:       "uid-1",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: []byte(pod)},
+			})
+
+			expectedPatch := strings.ReplaceAll(data.expectedPatch, "HASH", store.get().hash)
+			if got := string(resp.Patch); got != expectedPatch {
+				t.Errorf("patch:\n==      got:%s\n== expected:%s", got, expectedPatch)
+			}
+			if got := resp.AuditAnnotations[auditAnnotationKey]; got != data.expectedAudit {
+				t.Errorf("audit:\n==      got:%s\n== expected:%s", got, data.expectedAudit)
+			}
+		})
+	}
+}
+
+// admissionResponse sends the request to the webhook and returns the response.
+func admissionResponse(t *testing.T, app *application,
+	request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+
+	t.Helper()
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  request,
+	}
+	body, errJSON := json.Marshal(review)
+	if errJSON != nil {
+		t.Fatalf("json: %v", errJSON)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handlerWebhook(app, rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	return resp.Response
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/ext"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// celCostLimit bounds the cost of one expression evaluation, like the
+// per-expression limit of kubernetes validating admission policies.
+// It applies to the cost estimated when rules are loaded, and to the
+// actual cost at runtime.
+const celCostLimit = 1_000_000
+
+// celEstimatedSize is the size assumed by the cost estimate for strings,
+// lists and maps taken from the variables, whose size is unknown without
+// a schema. Actual bigger sizes are caught by the runtime cost limit.
+const celEstimatedSize = 100
+
+// celEnv declares the variables available to expressions:
+//
+//	object:          the object under admission (pod, daemonset or namespace)
+//	namespaceObject: the namespace of the object, as metadata.name and metadata.labels
+//	request:         the admission request: operation, namespace, name, uid, kind, userInfo, dryRun
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("namespaceObject", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+	)
+})
+
+// celSizeEstimator assumes celEstimatedSize for the unknown sizes,
+// and the default cost of function calls.
+type celSizeEstimator struct{}
+
+func (celSizeEstimator) EstimateSize(checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: celEstimatedSize}
+}
+
+func (celSizeEstimator) EstimateCallCost(string, string, *checker.AstNode,
+	[]checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+type celProgram struct {
+	expr string
+	prg  cel.Program
+}
+
+// compileCEL compiles a boolean expression.
+// The empty expression returns nil, which matches anything.
+// The variables are maps of dyn values, so an expression on their fields,
+// like object.spec.hostNetwork, is dyn and checked for bool at runtime,
+// see match(). Other result types are rejected.
+func compileCEL(expr string) (*celProgram, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	env, errEnv := celEnv()
+	if errEnv != nil {
+		return nil, fmt.Errorf("cel environment: %v", errEnv)
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("cel: '%s': %v", expr, issues.Err())
+	}
+
+	if out := ast.OutputType(); out != cel.BoolType && out != cel.DynType {
+		return nil, fmt.Errorf("cel: '%s': expression must return bool, got %v",
+			expr, out)
+	}
+
+	cost, errCost := env.EstimateCost(ast, celSizeEstimator{})
+	if errCost != nil {
+		return nil, fmt.Errorf("cel: '%s': cost estimate: %v", expr, errCost)
+	}
+	if cost.Max > celCostLimit {
+		return nil, fmt.Errorf("cel: '%s': estimated cost %d exceeds limit %d",
+			expr, cost.Max, celCostLimit)
+	}
+
+	prg, errPrg := env.Program(ast, cel.CostLimit(celCostLimit))
+	if errPrg != nil {
+		return nil, fmt.Errorf("cel: '%s': %v", expr, errPrg)
+	}
+
+	return &celProgram{expr: expr, prg: prg}, nil
+}
+
+// match evaluates the expression. Evaluation errors, like a missing
+// field or the cost limit exceeded, are logged and do not match.
+func (c *celProgram) match(in *celInput) bool {
+	if c == nil {
+		return true
+	}
+
+	out, _, errEval := c.prg.Eval(in.activation())
+	if errEval != nil {
+		log.Printf("cel: '%s': %v", c.expr, errEval)
+		return false
+	}
+
+	result, isBool := out.Value().(bool)
+	return isBool && result
+}
+
+// celInput builds the expression variables from the admission request,
+// only when some expression is evaluated.
+type celInput struct {
+	request         *admissionv1.AdmissionRequest
+	namespace       string
+	namespaceLabels map[string]string
+
+	once sync.Once
+	vars map[string]any
+}
+
+func newCELInput(request *admissionv1.AdmissionRequest, namespace string,
+	namespaceLabels map[string]string) *celInput {
+	return &celInput{
+		request:         request,
+		namespace:       namespace,
+		namespaceLabels: namespaceLabels,
+	}
+}
+
+func (in *celInput) activation() map[string]any {
+	if in == nil {
+		return map[string]any{
+			"object":          map[string]any{},
+			"namespaceObject": map[string]any{},
+			"request":         map[string]any{},
+		}
+	}
+	in.once.Do(in.build)
+	return in.vars
+}
+
+func (in *celInput) build() {
+	object := map[string]any{}
+	if len(in.request.Object.Raw) > 0 {
+		if err := json.Unmarshal(in.request.Object.Raw, &object); err != nil {
+			log.Printf("cel: %s/%s: decode object: %v",
+				in.request.Namespace, in.request.Name, err)
+		}
+	}
+
+	labels := map[string]any{}
+	for k, v := range in.namespaceLabels {
+		labels[k] = v
+	}
+
+	groups := make([]any, 0, len(in.request.UserInfo.Groups))
+	for _, g := range in.request.UserInfo.Groups {
+		groups = append(groups, g)
+	}
+
+	dryRun := in.request.DryRun != nil && *in.request.DryRun
+
+	in.vars = map[string]any{
+		"object": object,
+		"namespaceObject": map[string]any{
+			"metadata": map[string]any{
+				"name":   in.namespace,
+				"labels": labels,
+			},
+		},
+		"request": map[string]any{
+			"operation": string(in.request.Operation),
+			"namespace": in.request.Namespace,
+			"name":      in.request.Name,
+			"uid":       string(in.request.UID),
+			"kind": map[string]any{
+				"group":   in.request.Kind.Group,
+				"version": in.request.Kind.Version,
+				"kind":    in.request.Kind.Kind,
+			},
+			"userInfo": map[string]any{
+				"username": in.request.UserInfo.Username,
+				"uid":      in.request.UserInfo.UID,
+				"groups":   groups,
+			},
+			"dryRun": dryRun,
+		},
+	}
+}
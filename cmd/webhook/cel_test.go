@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const celPodJob = `{
+  "metadata": {
+    "name": "job-1-abc",
+    "labels": {"team": "a"},
+    "ownerReferences": [{"apiVersion": "batch/v1", "kind": "Job", "name": "job-1", "uid": "1"}]
+  },
+  "spec": {
+    "hostNetwork": true,
+    "containers": [
+      {"name": "c1", "image": "nginx", "resources": {"limits": {"memory": "1Gi"}}},
+      {"name": "c2", "image": "envoy"},
+      {"name": "c3", "image": "redis", "resources": {"limits": {"memory": "1Gi"}}}
+    ]
+  }
+}`
+
+type celTestCase struct {
+	name     string
+	expr     string
+	expected bool
+}
+
+var celTestTable = []celTestCase{
+	{"empty expression", "", true},
+	{"more than 2 containers", "size(object.spec.containers) > 2", true},
+	{"more than 3 containers", "size(object.spec.containers) > 3", false},
+	{"container without memory limit",
+		"object.spec.containers.exists(c, !has(c.resources) || !has(c.resources.limits.memory))", true},
+	{"owner is job with label",
+		"object.metadata.ownerReferences.exists(o, o.kind == 'Job') && object.metadata.labels.team == 'a'", true},
+	{"namespace label", "namespaceObject.metadata.labels.tier == 'dev'", true},
+	{"namespace name", "namespaceObject.metadata.name.startsWith('team-')", true},
+	{"request operation", "request.operation == 'UPDATE'", false},
+	{"request user", "'ci-admins' in request.userInfo.groups", true},
+	{"missing field does not match", "object.spec.nodeName == 'x'", false},
+	{"bool field checked at runtime", "object.spec.hostNetwork", true},
+	{"non-bool field does not match", "object.metadata.name", false},
+}
+
+func celTestInput() *celInput {
+	request := &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "team-a",
+		Operation: admissionv1.Create,
+		UserInfo: authenticationv1.UserInfo{
+			Username: "alice",
+			Groups:   []string{"system:authenticated", "ci-admins"},
+		},
+		Object: runtime.RawExtension{Raw: []byte(celPodJob)},
+	}
+	return newCELInput(request, "team-a", map[string]string{"tier": "dev"})
+}
+
+// go test -count 1 -run '^TestCEL$' ./cmd/webhook
+func TestCEL(t *testing.T) {
+	for i, data := range celTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(celTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			c, errCompile := compileCEL(data.expr)
+			if errCompile != nil {
+				t.Fatalf("compile: %v", errCompile)
+			}
+			if got := c.match(celTestInput()); got != data.expected {
+				t.Errorf("expr=%s got=%t expected=%t", data.expr, got, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestCELCompileErrors$' ./cmd/webhook
+func TestCELCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		"object.spec.containers.",  // syntax error
+		"size(object.spec) + 1",    // not bool
+		"unknown_variable == 1",    // undeclared
+		"'a' == 1 && 'b' == 'b'",   // type mismatch
+		"request.operation.size()", // not bool
+		"object.spec.containers.all(a, object.spec.containers.all(b, object.spec.containers.all(c, object.spec.containers.all(d, true))))", // estimated cost
+	} {
+		if _, err := compileCEL(expr); err == nil {
+			t.Errorf("expected compile error for: %s", expr)
+		}
+	}
+}
+
+// go test -count 1 -run '^TestCELCostLimit$' ./cmd/webhook
+func TestCELCostLimit(t *testing.T) {
+
+	// the estimated cost of literal lists is exact
+	const literal = `[1,2,3,4,5,6,7,8,9,10].all(a, [1,2,3,4,5,6,7,8,9,10].all(b,
+  [1,2,3,4,5,6,7,8,9,10].all(c, [1,2,3,4,5,6,7,8,9,10].all(d,
+  [1,2,3,4,5,6,7,8,9,10].all(e, [1,2,3,4,5,6,7,8,9,10].all(f, a > 0))))))`
+	if _, err := compileCEL(literal); err == nil {
+		t.Errorf("expected compile error when estimated cost exceeds the limit")
+	}
+
+	// the object is bigger than the estimate assumes
+	const expr = `object.spec.containers.all(a, object.spec.containers.all(b, a.name != ""))`
+	c, errCompile := compileCEL(expr)
+	if errCompile != nil {
+		t.Fatalf("compile: %v", errCompile)
+	}
+
+	containers := make([]string, 2000)
+	for i := range containers {
+		containers[i] = fmt.Sprintf(`{"name":"c%d"}`, i)
+	}
+	raw := `{"spec":{"containers":[` + strings.Join(containers, ",") + `]}}`
+	in := newCELInput(&admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(raw)},
+	}, "default", nil)
+
+	if c.match(in) {
+		t.Errorf("expected no match when cost limit is exceeded")
+	}
+}
+
+// go test -count 1 -run '^TestCELRules$' ./cmd/webhook
+func TestCELRules(t *testing.T) {
+	const input = `
+rules:
+- place_pods:
+  - pods:
+      - cel: size(object.spec.containers) > 2
+    add:
+      node_selector:
+        node: big
+  disable_daemonsets:
+  - or:
+      - cel: has(object.metadata.labels) && object.metadata.labels.disable == 'yes'
+    node_selector:
+      x: y
+  namespaces_add_labels:
+  - cel: "!('istio-injection' in namespaceObject.metadata.labels)"
+    add_labels:
+      istio-injection: enabled
+`
+	list, errRules := newRules([]byte(input), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+	r := list.Rules[0]
+
+	if !r.PlacePods[0].match(podInfo{cel: celTestInput()}) {
+		t.Errorf("pod: expected match")
+	}
+
+	ds := newCELInput(&admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"labels":{"disable":"yes"}}}`)},
+	}, "default", nil)
+	if !r.DisableDaemonsets[0].match(daemonsetInfo{cel: ds}) {
+		t.Errorf("daemonset: expected match")
+	}
+	if r.DisableDaemonsets[0].match(daemonsetInfo{}) {
+		t.Errorf("daemonset: expected no match without input")
+	}
+
+	nsLabels := map[string]string{"istio-injection": "disabled"}
+	ns := newCELInput(&admissionv1.AdmissionRequest{}, "team-a", nsLabels)
+	if r.NamespacesAddLabels[0].match(namespaceInfo{name: "team-a", labels: nsLabels, cel: ns}) {
+		t.Errorf("namespace: expected no match")
+	}
+
+	const bad = `
+rules:
+- resources:
+  - pod:
+      cel: size(object.spec.containers)
+`
+	if _, err := newRules([]byte(bad), true); err == nil {
+		t.Errorf("expected error for non-bool cel expression")
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 type config struct {
 	debug                   bool
+	dryRun                  bool
 	addr                    string
 	route                   string
 	health                  string
@@ -31,13 +32,23 @@ type config struct {
 	reinvocationPolicy  string
 	ignoreNamespaces    []string
 	acceptNodeSelectors []string
+	workloadTemplates   bool
 
-	rulesFile string
+	rulesFile           string
+	rulesReloadInterval time.Duration
+
+	rulesCRD            bool
+	rulesCRDResync      time.Duration
+	rulesCRDSyncTimeout time.Duration
+
+	namespaceCache            bool
+	namespaceCacheSyncTimeout time.Duration
 }
 
 func getConfig() config {
 	return config{
 		debug:                   envBool("DEBUG", false),
+		dryRun:                  envBool("DRY_RUN", false), // all rules in audit mode
 		addr:                    envString("ADDR", ":8443"),
 		route:                   envString("ROUTE", "/mutate"),
 		health:                  envString("HEALTH", "/health"),
@@ -59,7 +70,24 @@ func getConfig() config {
 		// space-separated list of nodeSelectors
 		acceptNodeSelectors: strings.Fields(envString("ACCEPT_NODE_SELECTORS", "kubernetes.io/os")),
 
+		// also apply pod rules to the pod template of deployments,
+		// statefulsets, replicasets, jobs and cronjobs
+		workloadTemplates: envBool("WORKLOAD_TEMPLATES", false),
+
 		rulesFile: envString("RULES", "rules.yaml"),
+
+		// zero disables rules hot reload
+		rulesReloadInterval: envDuration("RULES_RELOAD_INTERVAL", 10*time.Second),
+
+		// load additional rules from MutationRule custom resources
+		rulesCRD:            envBool("RULES_CRD", false),
+		rulesCRDResync:      envDuration("RULES_CRD_RESYNC", 10*time.Minute),
+		rulesCRDSyncTimeout: envDuration("RULES_CRD_SYNC_TIMEOUT", 30*time.Second),
+
+		// cache namespace labels for namespace_labels matching,
+		// started only when the rules use namespace labels
+		namespaceCache:            envBool("NAMESPACE_CACHE", true),
+		namespaceCacheSyncTimeout: envDuration("NAMESPACE_CACHE_SYNC_TIMEOUT", 30*time.Second),
 	}
 }
 
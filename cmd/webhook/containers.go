@@ -0,0 +1,269 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Container types selected by container_types in resources and in
+// place_pods add containers. A rule item without container_types
+// selects only the regular containers.
+const (
+	containerTypeContainers = "containers" // spec.containers
+	containerTypeInit       = "init"       // spec.initContainers, except sidecars
+	containerTypeSidecar    = "sidecar"    // spec.initContainers with restartPolicy Always
+	containerTypeEphemeral  = "ephemeral"  // spec.ephemeralContainers
+)
+
+var allContainerTypes = []string{containerTypeContainers, containerTypeInit,
+	containerTypeSidecar, containerTypeEphemeral}
+
+// subresourceEphemeralContainers is the pod subresource used to add
+// ephemeral containers, like kubectl debug does.
+const subresourceEphemeralContainers = "ephemeralcontainers"
+
+func checkContainerTypes(types []string) error {
+	for _, t := range types {
+		if !slices.Contains(allContainerTypes, t) {
+			return fmt.Errorf("bad container type: '%s' (expecting one of %v)",
+				t, allContainerTypes)
+		}
+	}
+	return nil
+}
+
+// checkRulesContainerTypes validates container_types.
+// Ephemeral containers do not accept resources.
+func checkRulesContainerTypes(r rulesConfig) error {
+	for _, i := range r.Resources {
+		if err := checkContainerTypes(i.ContainerTypes); err != nil {
+			return err
+		}
+		if slices.Contains(i.ContainerTypes, containerTypeEphemeral) {
+			return fmt.Errorf("resources: ephemeral containers do not accept resources")
+		}
+	}
+	for _, pc := range r.PlacePods {
+		for name, c := range pc.Add.Containers {
+			if err := checkContainerTypes(c.ContainerTypes); err != nil {
+				return fmt.Errorf("container '%s': %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// itemContainerTypes returns the container types a rule item selects.
+func itemContainerTypes(types []string) []string {
+	if len(types) == 0 {
+		return []string{containerTypeContainers}
+	}
+	return types
+}
+
+// podContainer is a container of the pod spec, changed in place
+// through the pointer.
+type podContainer struct {
+	containerType string
+	index         int // index in the array of the container type
+	*corev1.Container
+}
+
+// selectContainers returns the containers of the given types, in the order
+// containers, init containers (including sidecars), ephemeral containers.
+func selectContainers(spec *corev1.PodSpec, types []string) []podContainer {
+	types = itemContainerTypes(types)
+
+	var list []podContainer
+
+	if slices.Contains(types, containerTypeContainers) {
+		for i := range spec.Containers {
+			list = append(list, podContainer{containerTypeContainers, i,
+				&spec.Containers[i]})
+		}
+	}
+
+	for i := range spec.InitContainers {
+		t := containerTypeInit
+		if isSidecar(spec.InitContainers[i]) {
+			t = containerTypeSidecar
+		}
+		if slices.Contains(types, t) {
+			list = append(list, podContainer{t, i, &spec.InitContainers[i]})
+		}
+	}
+
+	if slices.Contains(types, containerTypeEphemeral) {
+		for i := range spec.EphemeralContainers {
+			// the common fields of ephemeral containers are a container
+			c := (*corev1.Container)(&spec.EphemeralContainers[i].EphemeralContainerCommon)
+			list = append(list, podContainer{containerTypeEphemeral, i, c})
+		}
+	}
+
+	return list
+}
+
+// isSidecar reports whether the init container is a native sidecar.
+func isSidecar(c corev1.Container) bool {
+	return c.RestartPolicy != nil &&
+		*c.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
+func (c podContainer) String() string {
+	return fmt.Sprintf("%s/%s(%d)", c.containerType, c.Name, c.index)
+}
+
+// Keys of place_pods add containers. A plain key is an exact container
+// name. A key with the regexp= prefix selects the containers matching the
+// pattern, like resources[].container, and the key * selects all containers.
+const (
+	containerNameRegexpPrefix = "regexp="
+	containerNameAll          = "*"
+)
+
+// compileContainerName returns the pattern of the key,
+// or nil for an exact container name.
+func compileContainerName(key string) (*pattern, error) {
+	if key == containerNameAll {
+		return patternCompile("")
+	}
+	if after, found := strings.CutPrefix(key, containerNameRegexpPrefix); found {
+		p, err := patternCompile(after)
+		if err != nil {
+			return nil, fmt.Errorf("container '%s': %v", key, err)
+		}
+		return p, nil
+	}
+	return nil, nil
+}
+
+// compileContainerConfig compiles the container key and the remove_env
+// patterns, checks the env_from and volume_mounts entries, and copies the
+// container on_conflict into the entries without their own, so that the
+// policy survives merged placements.
+func compileContainerConfig(key string, c containerConfig) (containerConfig, error) {
+	name, errName := compileContainerName(key)
+	if errName != nil {
+		return c, errName
+	}
+	c.name = name
+
+	c.removeEnv = nil
+	for _, r := range c.RemoveEnv {
+		p, errPat := patternCompile(r)
+		if errPat != nil {
+			return c, fmt.Errorf("container '%s': remove_env: '%s': %v", key, r, errPat)
+		}
+		c.removeEnv = append(c.removeEnv, p)
+	}
+
+	for _, entry := range c.EnvFrom {
+		if _, err := envFromConfig(entry); err != nil {
+			return c, fmt.Errorf("container '%s': %v", key, err)
+		}
+	}
+
+	for _, entry := range c.VolumeMounts {
+		if _, err := volumeMountFromConfig(entry); err != nil {
+			return c, fmt.Errorf("container '%s': %v", key, err)
+		}
+	}
+
+	if c.OnConflict != "" {
+		c.Env = withOnConflict(c.Env, c.OnConflict)
+		c.EnvFrom = withOnConflict(c.EnvFrom, c.OnConflict)
+	}
+
+	return c, nil
+}
+
+// withOnConflict sets the policy in the entries without on_conflict.
+func withOnConflict(entries []map[string]any, policy string) []map[string]any {
+	list := make([]map[string]any, 0, len(entries))
+	for _, entry := range entries {
+		if _, found := entry[envOnConflict]; !found {
+			entry = maps.Clone(entry)
+			entry[envOnConflict] = policy
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// containerKeys returns the keys of add containers in the order they
+// apply: exact names, then patterns, then *, each in sorted order.
+// With on_conflict skip, an env var set by an exact name is kept
+// over the same var set by a pattern.
+func containerKeys(addContainers map[string]containerConfig) []string {
+	rank := func(key string) int {
+		switch {
+		case key == containerNameAll:
+			return 2
+		case addContainers[key].name != nil:
+			return 1
+		}
+		return 0
+	}
+	return slices.SortedFunc(maps.Keys(addContainers), func(a, b string) int {
+		if c := cmp.Compare(rank(a), rank(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+}
+
+// selectContainers returns the containers selected by the entry with
+// the key, among its container types.
+func (c containerConfig) selectContainers(spec *corev1.PodSpec, key string) []podContainer {
+	var list []podContainer
+	for _, pc := range selectContainers(spec, c.ContainerTypes) {
+		if c.name == nil {
+			if pc.Name == key {
+				return []podContainer{pc} // container names are unique in the pod
+			}
+			continue
+		}
+		if c.name.matchString(pc.Name) {
+			list = append(list, pc)
+		}
+	}
+	return list
+}
+
+// selectsEphemeral reports whether some env config selects ephemeral containers.
+func (pc placementConfig) selectsEphemeral() bool {
+	for _, c := range pc.Add.Containers {
+		if slices.Contains(c.ContainerTypes, containerTypeEphemeral) {
+			return true
+		}
+	}
+	return false
+}
+
+// forEphemeralContainers keeps only the env injection into ephemeral
+// containers, for the pods/ephemeralcontainers subresource, which
+// accepts only changes to ephemeral containers.
+func (r rulesConfig) forEphemeralContainers() rulesConfig {
+	ephemeral := rulesConfig{Strategy: r.Strategy}
+	for _, pc := range r.PlacePods {
+		if !pc.selectsEphemeral() {
+			continue
+		}
+		containers := map[string]containerConfig{}
+		for name, c := range pc.Add.Containers {
+			if slices.Contains(c.ContainerTypes, containerTypeEphemeral) {
+				c.ContainerTypes = []string{containerTypeEphemeral}
+				containers[name] = c
+			}
+		}
+		pc.Add = addConfig{Containers: containers}
+		ephemeral.PlacePods = append(ephemeral.PlacePods, pc)
+	}
+	return ephemeral
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var containerTypesTestTable = []podRuleTestCase{
+	{
+		name: "env defaults to regular containers",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"ENV1","value":"VALUE1"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "env for init container",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        setup:
+          container_types: [init]
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		expected:    `[{"op":"add","path":"/spec/initContainers/0/env","value":[{"name":"ENV1","value":"VALUE1"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "sidecar is not an init container",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        proxy:
+          container_types: [init]
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		expected:    `[]`,
+		expectFired: `[]`,
+	},
+	{
+		name: "env for sidecar",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        proxy:
+          container_types: [sidecar]
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		expected:    `[{"op":"add","path":"/spec/initContainers/1/env","value":[{"name":"ENV1","value":"VALUE1"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "env for ephemeral container",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        debugger:
+          container_types: [ephemeral]
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		expected:    `[{"op":"add","path":"/spec/ephemeralContainers/0/env","value":[{"name":"ENV1","value":"VALUE1"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "merged placements look up all types",
+		rules: `
+rules:
+- strategy: merge
+  place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        proxy:
+          env:
+          - name: ENV1
+            value: VALUE1
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        proxy:
+          container_types: [sidecar]
+          env:
+          - name: ENV2
+            value: VALUE2
+`,
+		expected:    `[{"op":"add","path":"/spec/initContainers/1/env","value":[{"name":"ENV1","value":"VALUE1"},{"name":"ENV2","value":"VALUE2"}]}]`,
+		expectFired: `[rules[0].place_pods[0] rules[0].place_pods[1]]`,
+	},
+	{
+		name: "env for all containers",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        "*":
+          env:
+          - name: NODE_NAME
+            valueFrom:
+              fieldRef:
+                fieldPath: spec.nodeName
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}]} {"op":"add","path":"/spec/containers/1/env/-","value":{"name":"NODE_NAME","valueFrom":{"fieldRef":{"fieldPath":"spec.nodeName"}}}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "env for containers matching pattern",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        regexp=_^(app|setup)$:
+          container_types: [containers, init, sidecar]
+          env:
+          - name: ENV2
+            value: VALUE2
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/env/-","value":{"name":"ENV2","value":"VALUE2"}} {"op":"add","path":"/spec/initContainers/1/env","value":[{"name":"ENV2","value":"VALUE2"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "pattern matching no container",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        regexp=^istio-:
+          env:
+          - name: ENV2
+            value: VALUE2
+`,
+		expected:    `[]`,
+		expectFired: `[]`,
+	},
+	{
+		name: "exact name applies before pattern and all",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        "*":
+          env:
+          - name: ENV1
+            value: ALL
+        regexp=^w:
+          env:
+          - name: ENV1
+            value: PATTERN
+            on_conflict: overwrite
+        app:
+          env:
+          - name: ENV1
+            value: APP
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"ENV1","value":"APP"}]} {"op":"replace","path":"/spec/containers/1/env/0/value","value":"PATTERN"}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "resources for init containers and sidecars",
+		rules: `
+rules:
+- resources:
+  - container_types: [init, sidecar]
+    memory:
+      requests: 100Mi
+`,
+		expected:    `[{"op":"add","path":"/spec/initContainers/0/resources/requests","value":{"memory":"100Mi"}} {"op":"add","path":"/spec/initContainers/1/resources/requests","value":{"memory":"100Mi"}}]`,
+		expectFired: `[rules[0].resources[0]]`,
+	},
+	{
+		name: "resources final per container type",
+		rules: `
+rules:
+- resources:
+  - container_types: [sidecar]
+    final: true
+    memory:
+      requests: 50Mi
+  - container_types: [containers, sidecar]
+    memory:
+      requests: 200Mi
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/resources/requests","value":{"memory":"200Mi"}} {"op":"add","path":"/spec/containers/1/resources/requests","value":{"memory":"200Mi"}} {"op":"add","path":"/spec/initContainers/1/resources/requests","value":{"memory":"50Mi"}}]`,
+		expectFired: `[rules[0].resources[0] rules[0].resources[1]]`,
+	},
+	{
+		name: "ephemeralcontainers subresource changes only ephemeral containers",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      tolerations:
+      - key: spot
+        operator: Exists
+      containers:
+        app:
+          env:
+          - name: ENV1
+            value: VALUE1
+        debugger:
+          container_types: [ephemeral]
+          env:
+          - name: ENV2
+            value: VALUE2
+  resources:
+  - memory:
+      requests: 100Mi
+`,
+		ephemeral:   true,
+		expected:    `[{"op":"add","path":"/spec/ephemeralContainers/0/env","value":[{"name":"ENV2","value":"VALUE2"}]}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+}
+
+// go test -count 1 -run '^TestContainerTypes$' ./cmd/webhook
+func TestContainerTypes(t *testing.T) {
+
+	always := corev1.ContainerRestartPolicyAlways
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app"},
+				{Name: "worker", Env: []corev1.EnvVar{{Name: "ENV1", Value: "OLD"}}},
+			},
+			InitContainers: []corev1.Container{
+				{Name: "setup"},
+				{Name: "proxy", RestartPolicy: &always},
+			},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}},
+			},
+		},
+	}
+
+	runPodRuleCases(t, pod, containerTypesTestTable,
+		func(info podInfo, spec *corev1.PodSpec, ordered rulesConfig) []string {
+			return mutatePod(info, spec, ordered, false)
+		})
+}
+
+// go test -count 1 -run '^TestContainerTypesBad$' ./cmd/webhook
+func TestContainerTypesBad(t *testing.T) {
+	inputs := []string{
+		`
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+          container_types: [initContainers]
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		`
+rules:
+- resources:
+  - container_types: [sidecars]
+`,
+		`
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        regexp=^app(:
+          env:
+          - name: ENV1
+            value: VALUE1
+`,
+		`
+rules:
+- resources:
+  - container_types: [containers, ephemeral]
+    memory:
+      requests: 100Mi
+`,
+	}
+	for i, input := range inputs {
+		if _, err := newRules([]byte(input), true); err == nil {
+			t.Errorf("%d of %d: expected error for bad container_types, got nil",
+				i+1, len(inputs))
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// mutationRuleGVR identifies the cluster-scoped MutationRule custom resource.
+// The spec of a MutationRule holds one rules section, with the same fields
+// as an item under rules: in the rules file.
+var mutationRuleGVR = schema.GroupVersionResource{
+	Group:    "webhook.udhos.github.io",
+	Version:  "v1alpha1",
+	Resource: "mutationrules",
+}
+
+const (
+	mutationRuleConditionReady = "Ready"
+	mutationRuleReasonActive   = "Active"
+	mutationRuleReasonInvalid  = "CompileError"
+)
+
+type crdRules struct {
+	client             dynamic.Interface
+	informer           cache.SharedIndexInformer
+	store              *rulesStore
+	requireKnownFields bool
+	trigger            chan struct{}
+}
+
+// startCRDRules watches MutationRule objects and merges them into the
+// active rules. Every change to any object recompiles the whole set,
+// in the order given by object name.
+func startCRDRules(config *rest.Config, store *rulesStore, requireKnownFields bool,
+	resync, syncTimeout time.Duration) error {
+
+	const me = "startCRDRules"
+
+	client, errClient := dynamic.NewForConfig(config)
+	if errClient != nil {
+		return fmt.Errorf("%s: dynamic client: %v", me, errClient)
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+
+	c := &crdRules{
+		client:             client,
+		informer:           factory.ForResource(mutationRuleGVR).Informer(),
+		store:              store,
+		requireKnownFields: requireKnownFields,
+		trigger:            make(chan struct{}, 1),
+	}
+
+	_, errHandler := c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(_ any) { c.notify() },
+		UpdateFunc: func(_, _ any) { c.notify() },
+		DeleteFunc: func(_ any) { c.notify() },
+	})
+	if errHandler != nil {
+		return fmt.Errorf("%s: event handler: %v", me, errHandler)
+	}
+
+	factory.Start(context.Background().Done())
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		log.Printf("%s: ERROR: %s: cache not synced after %v, is the CRD installed?",
+			me, mutationRuleGVR.String(), syncTimeout)
+	}
+
+	c.sync() // publish initial state before serving
+
+	go c.run()
+
+	return nil
+}
+
+// notify schedules a sync without blocking the informer.
+func (c *crdRules) notify() {
+	select {
+	case c.trigger <- struct{}{}:
+	default: // sync already pending
+	}
+}
+
+func (c *crdRules) run() {
+	for range c.trigger {
+		c.sync()
+	}
+}
+
+func (c *crdRules) sync() {
+	const me = "crdRules.sync"
+
+	var objs []*unstructured.Unstructured
+	for _, obj := range c.informer.GetStore().List() {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			objs = append(objs, u)
+		}
+	}
+
+	slices.SortFunc(objs, func(a, b *unstructured.Unstructured) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+
+	var list []rulesConfig
+	var failed []string
+
+	for _, u := range objs {
+		r, errCompile := compileMutationRule(u, c.requireKnownFields)
+		if errCompile == nil {
+			// rule names must be unique across custom resources
+			errCompile = checkRuleNames(append(slices.Clone(list), r))
+		}
+		if errCompile != nil {
+			log.Printf("%s: ERROR: %s/%s: rejected: %v",
+				me, mutationRuleGVR.Resource, u.GetName(), errCompile)
+			failed = append(failed, u.GetName())
+			c.setCondition(u, metav1.ConditionFalse, mutationRuleReasonInvalid,
+				errCompile.Error())
+			continue
+		}
+		list = append(list, r)
+		c.setCondition(u, metav1.ConditionTrue, mutationRuleReasonActive,
+			"rules compiled and active")
+	}
+
+	c.store.setCRDRules(list, failed)
+
+	log.Printf("%s: %s: active=%d rejected=%d %v",
+		me, mutationRuleGVR.Resource, len(list), len(failed), failed)
+}
+
+// compileMutationRule compiles the spec of a MutationRule object.
+func compileMutationRule(u *unstructured.Unstructured, requireKnownFields bool) (rulesConfig, error) {
+	spec, _, errSpec := unstructured.NestedMap(u.Object, "spec")
+	if errSpec != nil {
+		return rulesConfig{}, errSpec
+	}
+
+	// JSON is valid YAML, hence we can reuse the rules file parser
+	data, errJSON := json.Marshal(spec)
+	if errJSON != nil {
+		return rulesConfig{}, errJSON
+	}
+
+	return newRulesConfig(data, requireKnownFields,
+		mutationRuleGVR.Resource+"/"+u.GetName())
+}
+
+// setCondition updates the Ready condition in the object status,
+// only when it changes, to avoid feeding the informer with our own updates.
+func (c *crdRules) setCondition(u *unstructured.Unstructured,
+	status metav1.ConditionStatus, reason, message string) {
+
+	const me = "crdRules.setCondition"
+
+	obj := u.DeepCopy() // never modify informer cache
+
+	conditions, errGet := getConditions(obj)
+	if errGet != nil {
+		log.Printf("%s: ERROR: %s: %v", me, obj.GetName(), errGet)
+	}
+
+	changed := meta.SetStatusCondition(&conditions, metav1.Condition{
+		Type:               mutationRuleConditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: obj.GetGeneration(),
+	})
+	if !changed {
+		return
+	}
+
+	if errSet := setConditions(obj, conditions); errSet != nil {
+		log.Printf("%s: ERROR: %s: %v", me, obj.GetName(), errSet)
+		return
+	}
+
+	_, errUpdate := c.client.Resource(mutationRuleGVR).UpdateStatus(context.TODO(),
+		obj, metav1.UpdateOptions{})
+	if errUpdate != nil {
+		log.Printf("%s: ERROR: %s: update status: %v", me, obj.GetName(), errUpdate)
+	}
+}
+
+func getConditions(u *unstructured.Unstructured) ([]metav1.Condition, error) {
+	list, found, err := unstructured.NestedSlice(u.Object, "status", "conditions")
+	if err != nil || !found {
+		return nil, err
+	}
+	var conditions []metav1.Condition
+	for _, item := range list {
+		m, isMap := item.(map[string]any)
+		if !isMap {
+			continue
+		}
+		var cond metav1.Condition
+		if errConv := runtime.DefaultUnstructuredConverter.FromUnstructured(m, &cond); errConv != nil {
+			return nil, errConv
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+func setConditions(u *unstructured.Unstructured, conditions []metav1.Condition) error {
+	list := make([]any, 0, len(conditions))
+	for i := range conditions {
+		m, errConv := runtime.DefaultUnstructuredConverter.ToUnstructured(&conditions[i])
+		if errConv != nil {
+			return errConv
+		}
+		list = append(list, m)
+	}
+	return unstructured.SetNestedSlice(u.Object, list, "status", "conditions")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newMutationRule(name string, spec map[string]any) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "webhook.udhos.github.io/v1alpha1",
+		"kind":       "MutationRule",
+		"metadata":   map[string]any{"name": name},
+		"spec":       spec,
+	}}
+	return u
+}
+
+// go test -count 1 -run '^TestCompileMutationRule$' ./cmd/webhook
+func TestCompileMutationRule(t *testing.T) {
+
+	good := newMutationRule("good", map[string]any{
+		"place_pods": []any{
+			map[string]any{
+				"pods": []any{map[string]any{"namespace": "^team-a$"}},
+				"add": map[string]any{
+					"node_selector": map[string]any{"node": "alpha"},
+				},
+			},
+		},
+		"resources": []any{
+			map[string]any{
+				"pod":       map[string]any{"namespace": ""},
+				"container": "",
+				"memory":    map[string]any{"requests": "11M"},
+			},
+		},
+	})
+
+	r, errGood := compileMutationRule(good, true)
+	if errGood != nil {
+		t.Fatalf("good rule: unexpected error: %v", errGood)
+	}
+	if len(r.PlacePods) != 1 || r.PlacePods[0].Add.NodeSelector["node"] != "alpha" {
+		t.Errorf("good rule: bad place_pods: %v", r.PlacePods)
+	}
+	if len(r.Resources) != 1 || r.Resources[0].container == nil {
+		t.Errorf("good rule: resources not compiled: %v", r.Resources)
+	}
+
+	badPattern := newMutationRule("bad-pattern", map[string]any{
+		"place_pods": []any{
+			map[string]any{
+				"pods": []any{map[string]any{"namespace": "("}},
+			},
+		},
+	})
+	if _, err := compileMutationRule(badPattern, false); err == nil {
+		t.Errorf("bad pattern: expected error, got nil")
+	}
+
+	unknownField := newMutationRule("unknown-field", map[string]any{
+		"place_pods_typo": []any{},
+	})
+	if _, err := compileMutationRule(unknownField, false); err != nil {
+		t.Errorf("unknown field: unexpected error without strict mode: %v", err)
+	}
+	if _, err := compileMutationRule(unknownField, true); err == nil {
+		t.Errorf("unknown field: expected error with strict mode, got nil")
+	}
+
+	empty := newMutationRule("empty", nil)
+	delete(empty.Object, "spec")
+	if _, err := compileMutationRule(empty, true); err != nil {
+		t.Errorf("empty spec: unexpected error: %v", err)
+	}
+}
+
+// go test -count 1 -run '^TestMutationRuleConditions$' ./cmd/webhook
+func TestMutationRuleConditions(t *testing.T) {
+
+	u := newMutationRule("cond", map[string]any{})
+
+	conditions, errGet := getConditions(u)
+	if errGet != nil || len(conditions) != 0 {
+		t.Fatalf("missing status: conditions=%v error=%v", conditions, errGet)
+	}
+
+	meta.SetStatusCondition(&conditions, metav1.Condition{
+		Type:    mutationRuleConditionReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  mutationRuleReasonInvalid,
+		Message: "bad pattern",
+	})
+
+	if errSet := setConditions(u, conditions); errSet != nil {
+		t.Fatalf("set conditions: %v", errSet)
+	}
+
+	got, errGet2 := getConditions(u)
+	if errGet2 != nil {
+		t.Fatalf("get conditions: %v", errGet2)
+	}
+
+	c := meta.FindStatusCondition(got, mutationRuleConditionReady)
+	if c == nil {
+		t.Fatalf("condition %s not found: %v", mutationRuleConditionReady, got)
+	}
+	if c.Status != metav1.ConditionFalse || c.Reason != mutationRuleReasonInvalid ||
+		c.Message != "bad pattern" {
+		t.Errorf("unexpected condition: %#v", c)
+	}
+}
+
+// go test -count 1 -run '^TestRulesStoreMergeCRD$' ./cmd/webhook
+func TestRulesStoreMergeCRD(t *testing.T) {
+
+	nodeOf := func(r rulesConfig) string {
+		return r.PlacePods[0].Add.NodeSelector["node"]
+	}
+
+	file, errFile := newRules([]byte(reloadRules1), false)
+	if errFile != nil {
+		t.Fatalf("file rules: %v", errFile)
+	}
+
+	store := &rulesStore{}
+	store.file = file
+
+	crd := rulesConfig{PlacePods: []placementConfig{
+		{Add: addConfig{NodeSelector: map[string]string{"node": "crd"}}},
+	}}
+
+	store.setCRDRules([]rulesConfig{crd}, []string{"broken"})
+
+	rules := store.get().Rules
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rule sections, got %d", len(rules))
+	}
+	if nodeOf(rules[0]) != "alpha" || nodeOf(rules[1]) != "crd" {
+		t.Errorf("wrong merge order: %s %s", nodeOf(rules[0]), nodeOf(rules[1]))
+	}
+
+	// removing all custom resources leaves only file rules
+	store.setCRDRules(nil, nil)
+	if n := len(store.get().Rules); n != 1 {
+		t.Errorf("expected 1 rule section, got %d", n)
+	}
+}
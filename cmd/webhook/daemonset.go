@@ -1,65 +1,69 @@
 package main
 
 import (
-	"fmt"
 	"log"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
-func daemonsetNodeSelector(namespace string, dsName string,
-	dsLabels map[string]string,
+// daemonsetNodeSelector disables matching daemonsets with a node selector
+// on the pod template spec. It returns the rules that changed the spec.
+// disableDaemonsets must be in evaluation order, see orderRules().
+// Node selectors from several matching rules are merged key by key.
+func daemonsetNodeSelector(dsInfo daemonsetInfo, spec *corev1.PodSpec,
 	disableDaemonsets []selectDaemonset) []string {
 
 	const me = "daemonsetNodeSelector"
 
+	namespace := dsInfo.namespace
+	dsName := dsInfo.name
+	dsLabels := dsInfo.labels
+
 	//
 	// scan daemonset rules
 	//
-	for _, ds := range disableDaemonsets {
+	matched, ids := selectRules(me, disableDaemonsets,
+		func(ds selectDaemonset) bool { return ds.match(dsInfo) })
 
-		if !ds.match(namespace, dsName, dsLabels) {
-			log.Printf("%s: %s/%s labels=%v: skipped", me, namespace, dsName, dsLabels)
-			continue
-		}
+	if len(matched) == 0 {
+		log.Printf("%s: %s/%s labels=%v: skipped", me, namespace, dsName, dsLabels)
+		return nil
+	}
 
-		//
-		// found rule for daemonset
-		//
+	//
+	// found rules for daemonset
+	//
 
-		if len(ds.NodeSelector) > 0 {
+	label := "custom"
+	var nodeSelectors []map[string]string
+	var nodeSelectorIDs []string
+	for _, ds := range mergeOrder(matched) {
+		nodeSelector := ds.NodeSelector
+		if len(nodeSelector) == 0 {
 			//
-			// add configured node selector
+			// add default node selector
 			//
-			return disable(me, "custom", namespace, dsName, dsLabels, ds.NodeSelector)
+			label = "default"
+			nodeSelector = map[string]string{"non-existing": "true"}
 		}
-
-		//
-		// add default node selector
-		//
-		return disable(me, "default", namespace, dsName, dsLabels, map[string]string{"non-existing": "true"})
+		nodeSelectors = append(nodeSelectors, nodeSelector)
+		nodeSelectorIDs = append(nodeSelectorIDs, ds.id)
 	}
+	if len(matched) > 1 {
+		label = "merged"
+	}
+
+	nodeSelector := mergeLabels(me, "nodeSelector", nodeSelectorIDs, nodeSelectors)
 
-	return nil
+	disable(me, label, namespace, dsName, dsLabels, spec, nodeSelector)
+
+	return ids
 }
 
-func disable(caller, label, namespace, dsName string, dsLabels, nodeSelector map[string]string) []string {
+func disable(caller, label, namespace, dsName string, dsLabels map[string]string,
+	spec *corev1.PodSpec, nodeSelector map[string]string) {
 	log.Printf("%s: %s/%s labels=%v: disabling with %s nodeSelector=%v",
 		caller, namespace, dsName, dsLabels, label, nodeSelector)
 
-	var list []string
-	ns, errNs := addNodeSelectorOnTemplate(nodeSelector)
-	if errNs != nil {
-		log.Printf("ERROR: %s %s: %v", caller, label, errNs)
-		return list
-	}
-	list = append(list, ns)
-	return list
-}
-
-func addNodeSelectorOnTemplate(nodeSelector map[string]string) (string, error) {
-	value, errJSON := labelsToJSONString(nodeSelector)
-	if errJSON != nil {
-		return "", fmt.Errorf("addNodeSelectorOnTemplate: %v", errJSON)
-	}
-	return fmt.Sprintf(`{"op":"add","path":"/spec/template/spec/nodeSelector","value":%s}`,
-		value), nil
+	spec.NodeSelector = nodeSelector
 }
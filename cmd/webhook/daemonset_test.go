@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
 )
 
 type daemonsetTestCase struct {
@@ -12,6 +14,8 @@ type daemonsetTestCase struct {
 	namespace string
 	dsName    string
 	dsLabels  string
+	nsLabels  string
+	dsAnnots  map[string]string
 	expected  string
 }
 
@@ -72,8 +76,54 @@ var daemonsetTestTable = []daemonsetTestCase{
 		dsLabels:  ``,
 		expected:  `[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"non-existing":"true"}}]`,
 	},
+	{
+		name:      "match by namespace labels",
+		rules:     matchNamespaceLabels,
+		namespace: "dev1",
+		dsName:    "ds1",
+		nsLabels:  `{"tier":"dev"}`,
+		expected:  `[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"non-existing":"true"}}]`,
+	},
+	{
+		name:      "mismatch by namespace labels",
+		rules:     matchNamespaceLabels,
+		namespace: "prod1",
+		dsName:    "ds1",
+		nsLabels:  `{"tier":"prod"}`,
+		expected:  `[]`,
+	},
+	{
+		name:      "match by annotations",
+		rules:     matchAnnotations,
+		namespace: "default",
+		dsName:    "ds1",
+		dsAnnots:  map[string]string{"example.com/disable": "yes"},
+		expected:  `[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"non-existing":"true"}}]`,
+	},
+	{
+		name:      "mismatch by annotations",
+		rules:     matchAnnotations,
+		namespace: "default",
+		dsName:    "ds1",
+		dsAnnots:  map[string]string{"example.com/disable": "no"},
+		expected:  `[]`,
+	},
 }
 
+const matchNamespaceLabels = `
+rules:
+- disable_daemonsets:
+  - namespace_labels:
+      tier: "regexp=^(dev|test)$"
+`
+
+const matchAnnotations = `
+rules:
+- disable_daemonsets:
+  - annotations:
+      example.com/disable: "regexp=^(true|yes)$"
+`
+
 const matchAnyDaemonset = `
 rules:
 - disable_daemonsets:
@@ -156,9 +206,27 @@ func TestDaemonset(t *testing.T) {
 				r = ruleList.Rules[0]
 			}
 
-			list := daemonsetNodeSelector(data.namespace, data.dsName, dsLabels, r.DisableDaemonsets)
+			var nsLabels map[string]string
+			if data.nsLabels != "" {
+				errLab := json.Unmarshal([]byte(data.nsLabels), &nsLabels)
+				if errLab != nil {
+					t.Errorf("bad namespace labels: %v", errLab)
+				}
+			}
+
+			ds := daemonsetInfo{
+				namespace:       data.namespace,
+				name:            data.dsName,
+				labels:          dsLabels,
+				annotations:     data.dsAnnots,
+				namespaceLabels: nsLabels,
+			}
+
+			var obj appsv1.DaemonSet
+			mutated := obj.DeepCopy()
+			daemonsetNodeSelector(ds, &mutated.Spec.Template.Spec, r.DisableDaemonsets)
 
-			result := fmt.Sprintf("%v", list)
+			result := diffString(t, &obj, mutated)
 
 			if result != data.expected {
 				t.Errorf("got='%s' expected='%s'", result, data.expected)
@@ -167,3 +235,50 @@ func TestDaemonset(t *testing.T) {
 
 	}
 }
+
+const daemonsetMultiGroup = `
+rules:
+- disable_daemonsets:
+  - name: ^ds1$
+    node_selector:
+      a: "1"
+- disable_daemonsets:
+  - namespace: ^default$
+    node_selector:
+      b: "2"
+- strategy: merge
+  disable_daemonsets:
+  - name: ^ds1$
+    node_selector:
+      a: "3"
+  - name: ^ds1$
+    priority: -1
+    node_selector:
+      c: "4"
+`
+
+// go test -count 1 -run '^TestDaemonsetMultiGroup$' ./cmd/webhook
+func TestDaemonsetMultiGroup(t *testing.T) {
+	list, errRules := newRules([]byte(daemonsetMultiGroup), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	for _, data := range []struct {
+		name     string
+		expected string
+	}{
+		// all groups apply, the later a=3 overrides a=1 at the same priority
+		{"ds1", `[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"a":"3","b":"2","c":"4"}}] [rules[0].disable_daemonsets[0] rules[1].disable_daemonsets[0] rules[2].disable_daemonsets[0] rules[2].disable_daemonsets[1]]`},
+		// only the second group matches
+		{"ds2", `[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"b":"2"}}] [rules[1].disable_daemonsets[0]]`},
+	} {
+		ds := daemonsetInfo{namespace: "default", name: data.name}
+		var obj appsv1.DaemonSet
+		mutated := obj.DeepCopy()
+		fired := daemonsetNodeSelector(ds, &mutated.Spec.Template.Spec, list.ordered.DisableDaemonsets)
+		if got := diffString(t, &obj, mutated) + fmt.Sprintf(" %v", fired); got != data.expected {
+			t.Errorf("%s:\n==      got:%s\n== expected:%s", data.name, got, data.expected)
+		}
+	}
+}
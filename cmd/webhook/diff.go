@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// diffPatch computes the patch that turns the original object into the
+// mutated one. Rules mutate a deep copy of the decoded object, and the
+// handlers send the diff as the JSON patch.
+func diffPatch(original, mutated any) ([]patchOp, error) {
+	before, errBefore := normalizeJSON(original)
+	if errBefore != nil {
+		return nil, fmt.Errorf("diffPatch: original: %v", errBefore)
+	}
+	after, errAfter := normalizeJSON(mutated)
+	if errAfter != nil {
+		return nil, fmt.Errorf("diffPatch: mutated: %v", errAfter)
+	}
+	var list []patchOp
+	diffJSON(nil, before, after, &list)
+	return list, nil
+}
+
+// diffJSON appends the operations that turn a into b, both in the
+// generic form of decoded JSON, at the path given by segments.
+//
+// Maps are compared key by key, in sorted key order.
+// In arrays, the items of a missing from b are removed, starting from
+// the last index, and the remaining items of b are appended; unless
+// the arrays have the same size and fewer items are changed in place.
+func diffJSON(segments []string, a, b any, list *[]patchOp) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+
+	path := jsonPointer(segments...)
+
+	switch before := a.(type) {
+	case map[string]any:
+		after, isMap := b.(map[string]any)
+		if !isMap {
+			break
+		}
+		keys := slices.Collect(maps.Keys(before))
+		for k := range after {
+			if _, found := before[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			child := append(slices.Clone(segments), k)
+			va, inA := before[k]
+			vb, inB := after[k]
+			switch {
+			case !inB:
+				*list = append(*list, patchRemove(jsonPointer(child...)))
+			case !inA:
+				*list = append(*list, patchAdd(jsonPointer(child...), vb))
+			default:
+				diffJSON(child, va, vb, list)
+			}
+		}
+		return
+
+	case []any:
+		after, isArray := b.([]any)
+		if !isArray {
+			break
+		}
+
+		// keep the items of a found in order in b, remove the others,
+		// then append the remaining items of b
+		var j int
+		var removed []int
+		for i, item := range before {
+			if j < len(after) && reflect.DeepEqual(item, after[j]) {
+				j++
+				continue
+			}
+			removed = append(removed, i)
+		}
+
+		// arrays of the same size changed in place, like containers,
+		// are compared item by item
+		if len(before) == len(after) &&
+			countChanged(before, after) < len(removed)+len(after)-j {
+			for i := range before {
+				child := append(slices.Clone(segments), strconv.Itoa(i))
+				diffJSON(child, before[i], after[i], list)
+			}
+			return
+		}
+
+		for _, i := range slices.Backward(removed) {
+			*list = append(*list, patchRemove(jsonPointer(append(slices.Clone(segments),
+				strconv.Itoa(i))...)))
+		}
+		for _, item := range after[j:] {
+			*list = append(*list, patchAdd(jsonPointer(append(slices.Clone(segments),
+				"-")...), item))
+		}
+		return
+	}
+
+	*list = append(*list, patchReplace(path, b))
+}
+
+// countChanged counts the items that differ between arrays of the same size.
+func countChanged(a, b []any) int {
+	var count int
+	for i := range a {
+		if !reflect.DeepEqual(a[i], b[i]) {
+			count++
+		}
+	}
+	return count
+}
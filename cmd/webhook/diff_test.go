@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// diffString is the patch from original to mutated, formatted for comparison.
+func diffString(t *testing.T, original, mutated any) string {
+	t.Helper()
+	list, errDiff := diffPatch(original, mutated)
+	if errDiff != nil {
+		t.Fatalf("diff: %v", errDiff)
+	}
+	return fmt.Sprintf("%v", list)
+}
+
+// podRuleTestCase is a case for runPodRuleCases.
+type podRuleTestCase struct {
+	name        string
+	rules       string
+	ephemeral   bool // pods/ephemeralcontainers subresource
+	expected    string
+	expectFired string
+}
+
+// runPodRuleCases applies the rules of each case to a copy of pod with
+// mutate, and checks the patch and the rules that fired.
+func runPodRuleCases(t *testing.T, pod corev1.Pod, table []podRuleTestCase,
+	mutate func(info podInfo, spec *corev1.PodSpec, ordered rulesConfig) []string) {
+
+	t.Helper()
+
+	for i, data := range table {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(table), data.name)
+		t.Run(name, func(t *testing.T) {
+			list, errRules := newRules([]byte(data.rules), true)
+			if errRules != nil {
+				t.Fatalf("rules: %v", errRules)
+			}
+
+			ordered := list.ordered
+			if data.ephemeral {
+				ordered = ordered.forEphemeralContainers()
+			}
+
+			mutated := pod.DeepCopy()
+			fired := mutate(podInfo{namespace: pod.Namespace, name: pod.Name},
+				&mutated.Spec, ordered)
+
+			if got := diffString(t, &pod, mutated); got != data.expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, data.expected)
+			}
+			if got := fmt.Sprintf("%v", fired); got != data.expectFired {
+				t.Errorf("fired: got=%s expected=%s", got, data.expectFired)
+			}
+		})
+	}
+}
+
+type diffTestCase struct {
+	name     string
+	before   string
+	after    string
+	expected string
+}
+
+var diffTestTable = []diffTestCase{
+	{"equal", `{"a":{"b":[1,2]}}`, `{"a":{"b":[1,2]}}`, `[]`},
+	{"add key", `{"a":{}}`, `{"a":{"b/c":"1"}}`,
+		`[{"op":"add","path":"/a/b~1c","value":"1"}]`},
+	{"keys in sorted order", `{"z":1,"b":1}`, `{"a":2,"b":2}`,
+		`[{"op":"add","path":"/a","value":2} {"op":"replace","path":"/b","value":2} {"op":"remove","path":"/z"}]`},
+	{"same size array", `{"a":[{"k":1},{"k":2}]}`, `{"a":[{"k":1},{"k":3}]}`,
+		`[{"op":"replace","path":"/a/1/k","value":3}]`},
+	{"append", `{"a":[1]}`, `{"a":[1,2,3]}`,
+		`[{"op":"add","path":"/a/-","value":2} {"op":"add","path":"/a/-","value":3}]`},
+	{"remove from last index", `{"a":[1,2,3,4]}`, `{"a":[1,3]}`,
+		`[{"op":"remove","path":"/a/3"} {"op":"remove","path":"/a/1"}]`},
+	{"remove and append", `{"a":[1,2,3]}`, `{"a":[1,3,4,5]}`,
+		`[{"op":"remove","path":"/a/1"} {"op":"add","path":"/a/-","value":4} {"op":"add","path":"/a/-","value":5}]`},
+	{"same size remove and append", `{"a":[1,2,3]}`, `{"a":[1,3,4]}`,
+		`[{"op":"remove","path":"/a/1"} {"op":"add","path":"/a/-","value":4}]`},
+	{"type change", `{"a":[1]}`, `{"a":{"b":1}}`,
+		`[{"op":"replace","path":"/a","value":{"b":1}}]`},
+	{"new array", `{}`, `{"a":[1]}`,
+		`[{"op":"add","path":"/a","value":[1]}]`},
+}
+
+// go test -count 1 -run '^TestDiffPatch$' ./cmd/webhook
+func TestDiffPatch(t *testing.T) {
+	for i, data := range diffTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(diffTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			before, after := decodeJSON(t, data.before), decodeJSON(t, data.after)
+
+			if got := diffString(t, before, after); got != data.expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, data.expected)
+			}
+
+			// the patch must turn before into after
+			list, _ := diffPatch(before, after)
+			if len(list) == 0 {
+				return
+			}
+			patch, errDecode := jsonpatch.DecodePatch([]byte(marshalPatch(t, list)))
+			if errDecode != nil {
+				t.Fatalf("decode patch: %v", errDecode)
+			}
+			result, errApply := patch.Apply([]byte(data.before))
+			if errApply != nil {
+				t.Fatalf("apply patch: %v", errApply)
+			}
+			if got := decodeJSON(t, string(result)); !reflect.DeepEqual(got, after) {
+				t.Errorf("patched:%s expected:%s", result, data.after)
+			}
+		})
+	}
+}
+
+func decodeJSON(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("json: %v: %s", err, s)
+	}
+	return v
+}
+
+func marshalPatch(t *testing.T, list []patchOp) string {
+	t.Helper()
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	return string(data)
+}
+
+const diffPodRules = `
+rules:
+- restrict_tolerations:
+  - toleration:
+      key: ^spot$
+    allowed_pods:
+      - namespace: ^nobody$
+  place_pods:
+  - pods:
+      - namespace: ^default$
+    add:
+      tolerations:
+        - key: dedicated
+          operator: Equal
+          value: batch
+          effect: NoSchedule
+`
+
+// go test -count 1 -run '^TestDiffPodRules$' ./cmd/webhook
+func TestDiffPodRules(t *testing.T) {
+	list, errRules := newRules([]byte(diffPodRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}},
+			Tolerations: []corev1.Toleration{
+				{Key: "a", Operator: "Exists"},
+				{Key: "spot", Operator: "Exists"},
+				{Key: "b", Operator: "Exists"},
+			},
+		},
+	}
+
+	// rules interact on the same copy: removal, then addition
+	mutated := pod.DeepCopy()
+	fired := mutatePod(podInfo{namespace: "default", name: "pod-1"},
+		&mutated.Spec, list.ordered, false)
+
+	const expected = `[{"op":"remove","path":"/spec/tolerations/1"} {"op":"add","path":"/spec/tolerations/-","value":{"effect":"NoSchedule","key":"dedicated","operator":"Equal","value":"batch"}}] [rules[0].restrict_tolerations[0] rules[0].place_pods[0]]`
+
+	if got := diffString(t, &pod, mutated) + fmt.Sprintf(" %v", fired); got != expected {
+		t.Errorf("\n==      got:%s\n== expected:%s", got, expected)
+	}
+
+	raw, errJSON := json.Marshal(pod)
+	if errJSON != nil {
+		t.Fatalf("json: %v", errJSON)
+	}
+	request := &admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}
+	if _, err := objectPatch(request, &pod, mutated); err != nil {
+		t.Errorf("patch does not apply to the pod: %v", err)
+	}
+}
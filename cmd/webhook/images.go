@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// imagesConfig matches pods by container image.
+type imagesConfig struct {
+	Image          string `yaml:"image"`           // image pattern
+	Containers     string `yaml:"containers"`      // any (default) or all
+	InitContainers bool   `yaml:"init_containers"` // also check initContainers
+
+	image *pattern
+}
+
+const (
+	imagesAny = "any"
+	imagesAll = "all"
+)
+
+func compileImages(i imagesConfig) (imagesConfig, error) {
+	switch i.Containers {
+	case "", imagesAny, imagesAll:
+	default:
+		return i, fmt.Errorf("bad images containers: '%s' (expecting %s or %s)",
+			i.Containers, imagesAny, imagesAll)
+	}
+
+	if i.Image == "" {
+		return i, nil // images not matched
+	}
+
+	img, err := patternCompile(i.Image)
+	if err != nil {
+		return i, err
+	}
+	i.image = img
+
+	return i, nil
+}
+
+// match checks the image pattern against any or all containers.
+// Unconfigured image pattern matches every pod.
+func (i *imagesConfig) match(containers, initContainers []corev1.Container) bool {
+	if i.image == nil {
+		return true
+	}
+
+	list := containers
+	if i.InitContainers {
+		list = make([]corev1.Container, 0, len(containers)+len(initContainers))
+		list = append(list, containers...)
+		list = append(list, initContainers...)
+	}
+
+	if i.Containers == imagesAll {
+		if len(list) == 0 {
+			return false
+		}
+		for _, c := range list {
+			if !i.image.matchString(c.Image) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, c := range list {
+		if i.image.matchString(c.Image) {
+			return true
+		}
+	}
+	return false
+}
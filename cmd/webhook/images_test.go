@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type imagesTestCase struct {
+	name           string
+	images         imagesConfig
+	containers     []string
+	initContainers []string
+	expected       bool
+}
+
+var imagesTestTable = []imagesTestCase{
+	{"unconfigured matches anything", imagesConfig{}, nil, nil, true},
+	{"any matches one", imagesConfig{Image: "^busybox"}, []string{"nginx", "busybox:1.36"}, nil, true},
+	{"any matches none", imagesConfig{Image: "^busybox"}, []string{"nginx"}, nil, false},
+	{"all matches all", imagesConfig{Image: "^registry.internal/gpu-", Containers: "all"}, []string{"registry.internal/gpu-a", "registry.internal/gpu-b"}, nil, true},
+	{"all matches some", imagesConfig{Image: "^registry.internal/gpu-", Containers: "all"}, []string{"registry.internal/gpu-a", "nginx"}, nil, false},
+	{"all with no containers", imagesConfig{Image: "", Containers: "all"}, nil, nil, true},
+	{"init ignored by default", imagesConfig{Image: "^busybox"}, []string{"nginx"}, []string{"busybox"}, false},
+	{"init included", imagesConfig{Image: "^busybox", InitContainers: true}, []string{"nginx"}, []string{"busybox"}, true},
+	{"all includes init", imagesConfig{Image: "^nginx", Containers: "all", InitContainers: true}, []string{"nginx"}, []string{"busybox"}, false},
+	{"negated pattern", imagesConfig{Image: "_^busybox", Containers: "all"}, []string{"nginx", "redis"}, nil, true},
+}
+
+func toContainers(images []string) []corev1.Container {
+	var list []corev1.Container
+	for i, img := range images {
+		list = append(list, corev1.Container{Name: fmt.Sprintf("c%d", i), Image: img})
+	}
+	return list
+}
+
+// go test -count 1 -run '^TestImages$' ./cmd/webhook
+func TestImages(t *testing.T) {
+	for i, data := range imagesTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(imagesTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			images, errCompile := compileImages(data.images)
+			if errCompile != nil {
+				t.Fatalf("compile: %v", errCompile)
+			}
+			result := images.match(toContainers(data.containers),
+				toContainers(data.initContainers))
+			if result != data.expected {
+				t.Errorf("got=%t expected=%t", result, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestImagesBadContainers$' ./cmd/webhook
+func TestImagesBadContainers(t *testing.T) {
+	const input = `
+rules:
+- place_pods:
+  - pods:
+      - images:
+          image: ^busybox
+          containers: every
+`
+	if _, err := newRules([]byte(input), false); err == nil {
+		t.Errorf("expected error for bad images containers, got nil")
+	}
+}
+
+// go test -count 1 -run '^TestResourceByImage$' ./cmd/webhook
+func TestResourceByImage(t *testing.T) {
+	const input = `
+rules:
+- resources:
+  - pod:
+      images:
+        image: ^registry.internal/gpu-
+    image: ^registry.internal/gpu-
+    memory:
+      requests: 1Gi
+`
+	list, errRules := newRules([]byte(input), false)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	containers := []corev1.Container{
+		{Name: "sidecar", Image: "envoy"},
+		{Name: "worker", Image: "registry.internal/gpu-worker:1"},
+	}
+
+	pod := podInfo{namespace: "default", name: "pod-1", containers: containers}
+
+	original := corev1.Pod{Spec: corev1.PodSpec{Containers: containers}}
+	mutated := original.DeepCopy()
+	addResource(pod, &mutated.Spec, list.Rules[0].Resources, false)
+
+	const expected = `[{"op":"add","path":"/spec/containers/1/resources/requests","value":{"memory":"1Gi"}}]`
+
+	if got := diffString(t, &original, mutated); got != expected {
+		t.Errorf("\n==      got:%s\n== expected:%s", got, expected)
+	}
+
+	// pod without matching image is not selected
+	pod.containers = containers[:1]
+	if fired := addResource(pod, &corev1.PodSpec{Containers: containers[:1]}, list.Rules[0].Resources, false); len(fired) != 0 {
+		t.Errorf("unexpected change for pod without gpu image: %v", fired)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeConfig builds the cluster client config shared by the typed and
+// the dynamic clients. It attempts, in order: env var KUBECONFIG,
+// ~/.kube/config, then in-cluster config.
+func kubeConfig() (*rest.Config, error) {
+
+	const me = "kubeConfig"
+
+	kubeconfig := os.Getenv("KUBECONFIG")
+	log.Printf("DEBUG: %s: KUBECONFIG='%s'", me, kubeconfig)
+	if kubeconfig == "" {
+		home, errHome := os.UserHomeDir()
+		if errHome != nil {
+			log.Printf("DEBUG: %s: could not get home dir: %v", me, errHome)
+		}
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+
+	config, errKubeconfig := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if errKubeconfig == nil {
+		return config, nil
+	}
+	log.Printf("DEBUG: %s: kubeconfig: %v", me, errKubeconfig)
+
+	config, errInCluster := rest.InClusterConfig()
+	if errInCluster != nil {
+		log.Printf("DEBUG: %s: in-cluster-config: %v", me, errInCluster)
+		return nil, errors.New("could not get cluster config")
+	}
+
+	return config, nil
+}
@@ -10,12 +10,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 
 	_ "github.com/KimMachineGun/automemlimit"
-	"github.com/udhos/kube/kubeclient"
-	"gopkg.in/yaml.v3"
 	api_runtime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes"
 )
 
 func getVersion(me string) string {
@@ -26,7 +26,9 @@ func getVersion(me string) string {
 type application struct {
 	codecs serializer.CodecFactory
 	conf   config
-	rules  rulesList
+	rules  *rulesStore
+
+	namespaces atomic.Pointer[namespaceCache] // nil until started, see namespaceCacheAutostart()
 }
 
 func main() {
@@ -51,19 +53,51 @@ func main() {
 		conf:   getConfig(),
 	}
 
-	{
-		r, errRules := loadRules(app.conf.rulesFile, app.conf.requireKnownFields)
-		if errRules != nil {
-			log.Fatalf("rules load: %s: %v", app.conf.rulesFile, errRules)
-		}
+	defaults, errDefaults := acceptNodeSelectorsRules(app.conf.acceptNodeSelectors)
+	if errDefaults != nil {
+		log.Fatalf("rules: ACCEPT_NODE_SELECTORS: %v", errDefaults)
+	}
+
+	app.rules = &rulesStore{defaults: []rulesConfig{defaults}}
+
+	if _, errRules := app.rules.reload(app.conf.rulesFile, app.conf.requireKnownFields); errRules != nil {
+		log.Fatalf("rules load: %s: %v", app.conf.rulesFile, errRules)
+	}
+
+	//
+	// Create kube client
+	//
 
-		out, errY := yaml.Marshal(r)
-		if errY != nil {
-			log.Fatalf("rules yaml: %v", errY)
+	kubeConf, errConf := kubeConfig()
+	if errConf != nil {
+		log.Fatalf("Failed to create kube client: %v", errConf)
+	}
+	clientset, errClient := kubernetes.NewForConfig(kubeConf)
+	if errClient != nil {
+		log.Fatalf("Failed to create kube client: %v", errClient)
+	}
+
+	//
+	// Watch rules from custom resources
+	//
+
+	if app.conf.rulesCRD {
+		errCRD := startCRDRules(kubeConf, app.rules, app.conf.requireKnownFields,
+			app.conf.rulesCRDResync, app.conf.rulesCRDSyncTimeout)
+		if errCRD != nil {
+			log.Fatalf("rules crd: %v", errCRD)
 		}
-		log.Printf("rules loaded:\n%s", string(out))
+	}
+
+	logRules(app.rules.get())
 
-		app.rules = r
+	//
+	// Spawn rules hot reload
+	//
+
+	if app.conf.rulesReloadInterval > 0 {
+		go rulesAutoreload(app.rules, app.conf.rulesFile,
+			app.conf.requireKnownFields, app.conf.rulesReloadInterval)
 	}
 
 	//
@@ -94,28 +128,46 @@ func main() {
 	}
 
 	//
-	// Create kube client
+	// Cache namespace labels
 	//
-	options := kubeclient.Options{
-		DebugLog: true,
+
+	namespaceRulesChanged := app.rules.subscribe() // subscribe before reading rules
+	startNamespaces := func() {
+		app.namespaces.Store(startNamespaceCache(clientset,
+			app.conf.namespaceCacheSyncTimeout))
 	}
-	clientset, errClient := kubeclient.New(options)
-	if errClient != nil {
-		log.Fatalf("Failed to create kube client: %v", errClient)
+	if app.rules.get().usesNamespaceLabels() && app.conf.namespaceCache {
+		startNamespaces() // wait for the cache before serving requests
+	} else {
+		go namespaceCacheAutostart(app.rules, namespaceRulesChanged,
+			app.conf.namespaceCache, startNamespaces)
 	}
 
 	//
 	// Add certificate to webhook configuration
 	//
 
-	errWebhookConf := createOrUpdateMutatingWebhookConfiguration(clientset,
-		caPEM, webhookConfigName, app.conf.route, webhookServiceName,
-		webhookNamespace, app.conf.failurePolicy,
-		app.conf.namespaceExcludeLabel, app.conf.reinvocationPolicy)
-	if errWebhookConf != nil {
+	updateWebhookConf := func(ops webhookOperations) error {
+		return createOrUpdateMutatingWebhookConfiguration(clientset,
+			caPEM, webhookConfigName, app.conf.route, webhookServiceName,
+			webhookNamespace, app.conf.failurePolicy,
+			app.conf.namespaceExcludeLabel, app.conf.reinvocationPolicy, ops)
+	}
+
+	rulesChanged := app.rules.subscribe() // subscribe before reading rules
+	ops := rulesOperations(app.rules.get(), app.conf.workloadTemplates)
+
+	if errWebhookConf := updateWebhookConf(ops); errWebhookConf != nil {
 		log.Fatalf("Failed to create or update the mutating webhook configuration: %v", errWebhookConf)
 	}
 
+	//
+	// Keep webhook operations in sync with reloaded rules
+	//
+
+	go webhookConfigAutoupdate(app.rules, rulesChanged, ops,
+		app.conf.workloadTemplates, updateWebhookConf)
+
 	//
 	// Spawn certificate auto-check
 	//
@@ -168,6 +220,7 @@ func handlerRoot( /*app*/ _ *application, w http.ResponseWriter, r *http.Request
 	http.Error(w, "not found", 404)
 }
 
-func handlerHealth( /*app*/ _ *application, w http.ResponseWriter, _ /*r*/ *http.Request) {
+func handlerHealth(app *application, w http.ResponseWriter, _ /*r*/ *http.Request) {
 	fmt.Fprintln(w, "health ok")
+	fmt.Fprintln(w, app.rules.status())
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations added to mutated pods.
+const (
+	annotationPrefix     = "webhook.udhos.github.io/"
+	annotationMutatedBy  = annotationPrefix + "mutated-by"
+	annotationRulesHash  = annotationPrefix + "rules-hash"
+	rulesHashPrefixBytes = 6
+)
+
+// nameRules assigns the identity of every rule item: the rule_name,
+// if defined, or the item position within the rules.
+func nameRules(r rulesConfig, prefix string) {
+	for i := range r.RestrictTolerations {
+		r.RestrictTolerations[i].id = ruleID(r.RestrictTolerations[i].RuleName,
+			prefix, "restrict_tolerations", i)
+	}
+	for i := range r.RestrictNodeSelectors {
+		r.RestrictNodeSelectors[i].id = ruleID(r.RestrictNodeSelectors[i].RuleName,
+			prefix, "restrict_node_selectors", i)
+	}
+	for i := range r.RestrictNodeAffinity {
+		r.RestrictNodeAffinity[i].id = ruleID(r.RestrictNodeAffinity[i].RuleName,
+			prefix, "restrict_node_affinity", i)
+	}
+	for i := range r.PlacePods {
+		r.PlacePods[i].id = ruleID(r.PlacePods[i].RuleName,
+			prefix, "place_pods", i)
+	}
+	for i := range r.Resources {
+		r.Resources[i].id = ruleID(r.Resources[i].RuleName,
+			prefix, "resources", i)
+	}
+	for i := range r.DisableDaemonsets {
+		r.DisableDaemonsets[i].id = ruleID(r.DisableDaemonsets[i].RuleName,
+			prefix, "disable_daemonsets", i)
+	}
+	for i := range r.NamespacesAddLabels {
+		r.NamespacesAddLabels[i].id = ruleID(r.NamespacesAddLabels[i].RuleName,
+			prefix, "namespaces_add_labels", i)
+	}
+}
+
+// ids returns the ids of the rule items.
+func (r rulesConfig) ids() []string {
+	var ids []string
+	for _, i := range r.RestrictTolerations {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.RestrictNodeSelectors {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.RestrictNodeAffinity {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.PlacePods {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.Resources {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.DisableDaemonsets {
+		ids = append(ids, i.id)
+	}
+	for _, i := range r.NamespacesAddLabels {
+		ids = append(ids, i.id)
+	}
+	return ids
+}
+
+// checkRuleNames rejects a rule_name used by more than one rule item,
+// since the rules that fired are reported by name.
+func checkRuleNames(groups []rulesConfig) error {
+	seen := map[string]bool{}
+	for _, r := range groups {
+		for _, id := range r.ids() {
+			if seen[id] {
+				return fmt.Errorf("duplicate rule_name: '%s'", id)
+			}
+			seen[id] = true
+		}
+	}
+	return nil
+}
+
+func ruleID(ruleName, prefix, kind string, i int) string {
+	if ruleName != "" {
+		return ruleName
+	}
+	return fmt.Sprintf("%s.%s[%d]", prefix, kind, i)
+}
+
+// rulesHash identifies the rules content.
+func rulesHash(r rulesList) string {
+	data, errYaml := yaml.Marshal(r)
+	if errYaml != nil {
+		log.Printf("ERROR: rulesHash: %v", errYaml)
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:rulesHashPrefixBytes])
+}
+
+// addFired appends rule ids not yet recorded.
+func addFired(fired []string, ids ...string) []string {
+	for _, id := range ids {
+		if !slices.Contains(fired, id) {
+			fired = append(fired, id)
+		}
+	}
+	return fired
+}
+
+// mutatedBy records in the annotations the rules that changed the object.
+func mutatedBy(meta metav1.Object, fired []string, hash string) {
+	if len(fired) == 0 {
+		return
+	}
+
+	annotations := meta.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annotationMutatedBy] = strings.Join(fired, ",")
+	annotations[annotationRulesHash] = hash
+	meta.SetAnnotations(annotations)
+}
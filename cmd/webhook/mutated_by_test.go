@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const mutatedByRules = `
+rules:
+- restrict_tolerations:
+  - rule_name: no-key1
+    toleration:
+      key: ^key1$
+    allowed_pods:
+      - namespace: _
+- place_pods:
+  - pods:
+      - labels:
+          color: red
+    add:
+      node_selector:
+        node: red
+  - rule_name: spot
+    pods:
+      - namespace: ""
+    add:
+      priority_class_name: low
+`
+
+// go test -count 1 -run '^TestRuleNames$' ./cmd/webhook
+func TestRuleNames(t *testing.T) {
+
+	list, errRules := newRules([]byte(mutatedByRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	if id := list.Rules[0].RestrictTolerations[0].id; id != "no-key1" {
+		t.Errorf("named rule: got=%s expected=no-key1", id)
+	}
+	if id := list.Rules[1].PlacePods[0].id; id != "rules[1].place_pods[0]" {
+		t.Errorf("unnamed rule: got=%s expected=rules[1].place_pods[0]", id)
+	}
+	if id := list.Rules[1].PlacePods[1].id; id != "spot" {
+		t.Errorf("named rule: got=%s expected=spot", id)
+	}
+}
+
+// go test -count 1 -run '^TestRuleNamesDuplicate$' ./cmd/webhook
+func TestRuleNamesDuplicate(t *testing.T) {
+	inputs := []string{
+		`
+rules:
+- place_pods:
+  - rule_name: spot
+    add:
+      priority_class_name: low
+- resources:
+  - rule_name: spot
+    memory:
+      requests: 100Mi
+`,
+		`
+rules:
+- place_pods:
+  - add:
+      priority_class_name: low
+  - rule_name: rules[0].place_pods[0]
+    add:
+      priority_class_name: high
+`,
+	}
+	for i, input := range inputs {
+		_, err := newRules([]byte(input), true)
+		if err == nil {
+			t.Errorf("%d of %d: expected error for duplicate rule_name, got nil",
+				i+1, len(inputs))
+			continue
+		}
+		if !strings.Contains(err.Error(), "duplicate rule_name") {
+			t.Errorf("%d of %d: unexpected error: %v", i+1, len(inputs), err)
+		}
+	}
+}
+
+// go test -count 1 -run '^TestRulesFired$' ./cmd/webhook
+func TestRulesFired(t *testing.T) {
+
+	list, errRules := newRules([]byte(mutatedByRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Tolerations: []corev1.Toleration{
+				{Key: "key1", Operator: "Exists"},
+				{Key: "key2", Operator: "Exists"},
+			},
+		},
+	}
+
+	var fired []string
+	for _, r := range list.Rules {
+		f := mutatePod(podInfo{namespace: "default", name: "pod-1"},
+			&pod.DeepCopy().Spec, r, false)
+		fired = addFired(fired, f...)
+	}
+
+	if got := fmt.Sprintf("%v", fired); got != "[no-key1 spot]" {
+		t.Errorf("got=%s expected=[no-key1 spot]", got)
+	}
+}
+
+// go test -count 1 -run '^TestMutatedBy$' ./cmd/webhook
+func TestMutatedBy(t *testing.T) {
+
+	var pod corev1.Pod
+
+	mutated := pod.DeepCopy()
+	mutatedBy(&mutated.ObjectMeta, nil, "abc")
+	if got := diffString(t, &pod, mutated); got != "[]" {
+		t.Errorf("no rule fired: unexpected patch: %s", got)
+	}
+
+	const expectedNil = `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"a,b\"c","webhook.udhos.github.io/rules-hash":"abc"}}]`
+
+	mutated = pod.DeepCopy()
+	mutatedBy(&mutated.ObjectMeta, []string{"a", `b"c`}, "abc")
+	if got := diffString(t, &pod, mutated); got != expectedNil {
+		t.Errorf("nil annotations:\n==      got:%s\n== expected:%s", got, expectedNil)
+	}
+
+	const expected = `[{"op":"add","path":"/metadata/annotations/webhook.udhos.github.io~1mutated-by","value":"a"} {"op":"add","path":"/metadata/annotations/webhook.udhos.github.io~1rules-hash","value":"abc"}]`
+
+	pod.Annotations = map[string]string{"x": "y"}
+	mutated = pod.DeepCopy()
+	mutatedBy(&mutated.ObjectMeta, []string{"a"}, "abc")
+	if got := diffString(t, &pod, mutated); got != expected {
+		t.Errorf("existing annotations:\n==      got:%s\n== expected:%s", got, expected)
+	}
+}
+
+// go test -count 1 -run '^TestRulesHash$' ./cmd/webhook
+func TestRulesHash(t *testing.T) {
+	list1, _ := newRules([]byte(mutatedByRules), false)
+	list2, _ := newRules([]byte(mutatedByRules), false)
+	list3, _ := newRules([]byte(reloadRules1), false)
+
+	h1, h2, h3 := rulesHash(list1), rulesHash(list2), rulesHash(list3)
+
+	if h1 == "" || h1 != h2 {
+		t.Errorf("same rules should have same hash: %s %s", h1, h2)
+	}
+	if h1 == h3 {
+		t.Errorf("different rules should have different hash: %s %s", h1, h3)
+	}
+}
@@ -4,56 +4,51 @@ import (
 	"fmt"
 	"log"
 	"maps"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func namespaceAddLabels(name string, labels map[string]string, addLabels []nsAddLabels) []string {
+// namespaceAddLabels adds labels to matching namespaces.
+// It returns the rules that changed the labels.
+// addLabels must be in evaluation order, see orderRules().
+// Labels from several matching rules are merged key by key.
+func namespaceAddLabels(ns namespaceInfo, meta *metav1.ObjectMeta,
+	addLabels []nsAddLabels) []string {
 
-	me := fmt.Sprintf("namespaceAddLabels: namespace=%s", name)
+	me := fmt.Sprintf("namespaceAddLabels: namespace=%s", ns.name)
+	labels := ns.labels
 
 	//
 	// scan namespace rules
 	//
-	for _, add := range addLabels {
-
-		if !add.match(name) {
-			log.Printf("%s: skipped (no rule found)", me)
-			continue
-		}
+	matched, ids := selectRules(me, addLabels,
+		func(add nsAddLabels) bool { return add.match(ns) })
 
-		//
-		// found rule for namespace
-		//
+	if len(matched) == 0 {
+		log.Printf("%s: skipped (no rule found)", me)
+		return nil
+	}
 
-		lab := map[string]string{}
-		maps.Copy(lab, labels)
-		maps.Copy(lab, add.AddLabels)
+	//
+	// found rules for namespace
+	//
 
-		return addLabelsToNs(me, labels, add.AddLabels, lab)
+	var labelsIDs []string
+	var labelsList []map[string]string
+	for _, add := range mergeOrder(matched) {
+		labelsIDs = append(labelsIDs, add.id)
+		labelsList = append(labelsList, add.AddLabels)
 	}
+	add := mergeLabels(me, "label", labelsIDs, labelsList)
 
-	return nil
-}
-
-func addLabelsToNs(caller string, existing, add, result map[string]string) []string {
+	lab := map[string]string{}
+	maps.Copy(lab, labels)
+	maps.Copy(lab, add)
 
 	log.Printf("%s: labels: existing=%v adding=%v result=%v",
-		caller, existing, add, result)
+		me, labels, add, lab)
 
-	var list []string
-	ns, errAdd := addLabelsOnMetadata(result)
-	if errAdd != nil {
-		log.Printf("ERROR: %s: %v", caller, errAdd)
-		return list
-	}
-	list = append(list, ns)
-	return list
-}
+	meta.Labels = lab
 
-func addLabelsOnMetadata(add map[string]string) (string, error) {
-	value, errJSON := labelsToJSONString(add)
-	if errJSON != nil {
-		return "", fmt.Errorf("addLabelsOnMetadata: %v", errJSON)
-	}
-	return fmt.Sprintf(`{"op":"add","path":"/metadata/labels","value":%s}`,
-		value), nil
+	return ids
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceCache provides namespace labels from an informer cache,
+// hence matching namespace_labels does not call the api-server
+// in the admission request path.
+type namespaceCache struct {
+	lister corelisters.NamespaceLister
+}
+
+func startNamespaceCache(clientset kubernetes.Interface,
+	syncTimeout time.Duration) *namespaceCache {
+
+	const me = "startNamespaceCache"
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	nsInformer := factory.Core().V1().Namespaces()
+
+	c := &namespaceCache{lister: nsInformer.Lister()}
+	informer := nsInformer.Informer()
+
+	factory.Start(context.Background().Done())
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		log.Printf("%s: ERROR: cache not synced after %v", me, syncTimeout)
+	}
+
+	return c
+}
+
+// labels returns the labels for a namespace.
+// It returns nil for unknown namespace, or for nil cache.
+func (c *namespaceCache) labels(name string) map[string]string {
+	if c == nil || name == "" {
+		return nil
+	}
+	ns, err := c.lister.Get(name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("ERROR: namespaceCache: %s: %v", name, err)
+		}
+		return nil
+	}
+	return ns.Labels
+}
+
+// namespaceCacheAutostart starts the namespace cache when the rules first
+// use namespace labels, so that the cluster-wide namespace informer runs
+// only if needed. If the cache is disabled, rules using namespace labels
+// never match them, and an error is logged whenever such rules are loaded.
+func namespaceCacheAutostart(store *rulesStore, changed <-chan struct{},
+	enabled bool, start func()) {
+
+	const me = "namespaceCacheAutostart"
+
+	for {
+		if store.get().usesNamespaceLabels() {
+			if enabled {
+				log.Printf("%s: rules use namespace labels: starting namespace cache", me)
+				start()
+				return
+			}
+			log.Printf("%s: ERROR: rules use namespace labels, but NAMESPACE_CACHE=false: namespace labels never match",
+				me)
+		}
+		if _, ok := <-changed; !ok {
+			return
+		}
+	}
+}
+
+// usesNamespaceLabels reports whether the pod or daemonset matchers look
+// at namespace labels, with namespace_labels or with CEL namespaceObject.
+// Namespace matchers see the labels of the admitted namespace instead.
+func (l *rulesList) usesNamespaceLabels() bool {
+	for _, r := range l.Rules {
+		for _, i := range r.RestrictTolerations {
+			if podsUseNamespaceLabels(i.AllowedPods) {
+				return true
+			}
+		}
+		for _, i := range r.RestrictNodeSelectors {
+			if podsUseNamespaceLabels(i.AllowedPods) {
+				return true
+			}
+		}
+		for _, i := range r.RestrictNodeAffinity {
+			if podsUseNamespaceLabels(i.AllowedPods) {
+				return true
+			}
+		}
+		for _, i := range r.PlacePods {
+			if podsUseNamespaceLabels(i.Pods) {
+				return true
+			}
+		}
+		for _, i := range r.Resources {
+			if i.Pod.usesNamespaceLabels() {
+				return true
+			}
+		}
+		for _, i := range r.DisableDaemonsets {
+			if i.daemonsetConfig.usesNamespaceLabels() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func podsUseNamespaceLabels(pods []podConfig) bool {
+	for _, p := range pods {
+		if p.usesNamespaceLabels() {
+			return true
+		}
+	}
+	return false
+}
+
+// celUsesNamespace reports whether the CEL expression refers to the
+// namespaceObject variable.
+func celUsesNamespace(expr string) bool {
+	return strings.Contains(expr, "namespaceObject")
+}
+
+func (p podConfig) usesNamespaceLabels() bool {
+	if len(p.NamespaceLabels) > 0 || celUsesNamespace(p.CEL) {
+		return true
+	}
+	if p.Not != nil && p.Not.usesNamespaceLabels() {
+		return true
+	}
+	return podsUseNamespaceLabels(p.And) || podsUseNamespaceLabels(p.Or)
+}
+
+func (d daemonsetConfig) usesNamespaceLabels() bool {
+	if len(d.NamespaceLabels) > 0 || celUsesNamespace(d.CEL) {
+		return true
+	}
+	if d.Not != nil && d.Not.usesNamespaceLabels() {
+		return true
+	}
+	for _, list := range [][]daemonsetConfig{d.And, d.Or} {
+		for _, i := range list {
+			if i.usesNamespaceLabels() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// go test -count 1 -run '^TestNamespaceCache$' ./cmd/webhook
+func TestNamespaceCache(t *testing.T) {
+
+	clientset := fake.NewClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "team-a",
+			Labels: map[string]string{"team": "a"},
+		},
+	})
+
+	c := startNamespaceCache(clientset, 5*time.Second)
+
+	if v := c.labels("team-a")["team"]; v != "a" {
+		t.Errorf("team-a: got label team=%s expected=a", v)
+	}
+
+	if lab := c.labels("missing"); lab != nil {
+		t.Errorf("missing namespace: unexpected labels: %v", lab)
+	}
+
+	var disabled *namespaceCache
+	if lab := disabled.labels("team-a"); lab != nil {
+		t.Errorf("disabled cache: unexpected labels: %v", lab)
+	}
+}
+
+type namespaceLabelsUseTestCase struct {
+	name     string
+	rules    string
+	expected bool
+}
+
+var namespaceLabelsUseTestTable = []namespaceLabelsUseTestCase{
+	{
+		name: "no namespace labels",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ^team-a$
+    add:
+      priority_class_name: low
+- namespaces_add_labels:
+  - cel: has(namespaceObject.metadata.labels.team)
+    add_labels:
+      a: b
+`,
+		expected: false,
+	},
+	{
+		name: "namespace_labels nested in not",
+		rules: `
+rules:
+- restrict_tolerations:
+  - toleration:
+      key: ^spot$
+    allowed_pods:
+      - or:
+          - name: ^batch-
+          - not:
+              namespace_labels:
+                critical: "true"
+`,
+		expected: true,
+	},
+	{
+		name: "cel namespaceObject in resources",
+		rules: `
+rules:
+- resources:
+  - pod:
+      cel: namespaceObject.metadata.labels.team == "a"
+    memory:
+      requests: 100Mi
+`,
+		expected: true,
+	},
+	{
+		name: "daemonset namespace_labels",
+		rules: `
+rules:
+- disable_daemonsets:
+  - namespace_labels:
+      team: a
+`,
+		expected: true,
+	},
+}
+
+// go test -count 1 -run '^TestUsesNamespaceLabels$' ./cmd/webhook
+func TestUsesNamespaceLabels(t *testing.T) {
+	for i, data := range namespaceLabelsUseTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(namespaceLabelsUseTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			list, errRules := newRules([]byte(data.rules), true)
+			if errRules != nil {
+				t.Fatalf("rules: %v", errRules)
+			}
+			if got := list.usesNamespaceLabels(); got != data.expected {
+				t.Errorf("got=%t expected=%t", got, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestNamespaceCacheAutostart$' ./cmd/webhook
+func TestNamespaceCacheAutostart(t *testing.T) {
+
+	store := &rulesStore{}
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+
+	load := func(rules string) {
+		if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+			t.Fatalf("write rules: %v", err)
+		}
+		if _, err := store.reload(path, true); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+
+	load(`rules: []`)
+
+	changed := store.subscribe()
+	started := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		namespaceCacheAutostart(store, changed, true, func() { close(started) })
+		close(done)
+	}()
+
+	select {
+	case <-started:
+		t.Fatalf("cache started without namespace labels in rules")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	load(`
+rules:
+- place_pods:
+  - pods:
+      - namespace_labels:
+          team: a
+    add:
+      priority_class_name: low
+`)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cache not started after rules with namespace labels")
+	}
+
+	select {
+	case <-started:
+	default:
+		t.Errorf("autostart returned without starting the cache")
+	}
+}
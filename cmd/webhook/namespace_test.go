@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type namespaceTestCase struct {
@@ -39,7 +42,7 @@ var namespaceTestTable = []namespaceTestCase{
 		rules:    nsMatchAnyNamespace,
 		name:     "default",
 		labels:   `{"a":"b","c":"d"}`,
-		expected: `[{"op":"add","path":"/metadata/labels","value":{"a":"b","c":"d","istio-injection":"enabled"}}]`,
+		expected: `[{"op":"add","path":"/metadata/labels/istio-injection","value":"enabled"}]`,
 	},
 	{
 		testName: "match none",
@@ -139,9 +142,12 @@ func TestNamespace(t *testing.T) {
 				r = ruleList.Rules[0]
 			}
 
-			list := namespaceAddLabels(data.name, labels, r.NamespacesAddLabels)
+			ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: data.name, Labels: labels}}
+			mutated := ns.DeepCopy()
+			namespaceAddLabels(namespaceInfo{name: data.name, labels: labels},
+				&mutated.ObjectMeta, r.NamespacesAddLabels)
 
-			result := fmt.Sprintf("%v", list)
+			result := diffString(t, &ns, mutated)
 
 			if result != data.expected {
 				t.Errorf("got='%s' expected='%s' rule=%v",
@@ -151,3 +157,52 @@ func TestNamespace(t *testing.T) {
 
 	}
 }
+
+const namespaceMultiGroup = `
+rules:
+- namespaces_add_labels:
+  - name: ^team-
+    add_labels:
+      istio-injection: enabled
+      tier: default
+- namespaces_add_labels:
+  - name: ^team-a$
+    add_labels:
+      team: a
+- namespaces_add_labels:
+  - name: ^team-a$
+    priority: 10
+    final: true
+    add_labels:
+      tier: platform
+  - name: ""
+    add_labels:
+      fallback: "true"
+`
+
+// go test -count 1 -run '^TestNamespaceMultiGroup$' ./cmd/webhook
+func TestNamespaceMultiGroup(t *testing.T) {
+	list, errRules := newRules([]byte(namespaceMultiGroup), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	for _, data := range []struct {
+		name     string
+		expected string
+	}{
+		// final rule has higher priority, hence it is evaluated first and stops evaluation
+		{"team-a", `[{"op":"add","path":"/metadata/labels/tier","value":"platform"}] [rules[2].namespaces_add_labels[0]]`},
+		// labels from first and last groups are added
+		{"team-b", `[{"op":"add","path":"/metadata/labels/fallback","value":"true"} {"op":"add","path":"/metadata/labels/istio-injection","value":"enabled"} {"op":"add","path":"/metadata/labels/tier","value":"default"}] [rules[0].namespaces_add_labels[0] rules[2].namespaces_add_labels[1]]`},
+		{"other", `[{"op":"add","path":"/metadata/labels/fallback","value":"true"}] [rules[2].namespaces_add_labels[1]]`},
+	} {
+		info := namespaceInfo{name: data.name, labels: map[string]string{"a": "b"}}
+		ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: data.name, Labels: info.labels}}
+		mutated := ns.DeepCopy()
+		fired := namespaceAddLabels(info, &mutated.ObjectMeta, list.ordered.NamespacesAddLabels)
+		if got := diffString(t, &ns, mutated) + fmt.Sprintf(" %v", fired); got != data.expected {
+			t.Errorf("%s:\n==      got:%s\n== expected:%s", data.name, got, data.expected)
+		}
+	}
+}
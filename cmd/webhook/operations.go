@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+)
+
+// Admission operations a rule item can be restricted to.
+// A rule item without operations runs on both.
+const (
+	operationCreate = string(admissionregistrationv1.Create)
+	operationUpdate = string(admissionregistrationv1.Update)
+)
+
+var allOperations = []string{operationCreate, operationUpdate}
+
+func checkOperations(ops []string) error {
+	for _, op := range ops {
+		if !slices.Contains(allOperations, op) {
+			return fmt.Errorf("bad rule operation: '%s' (expecting %s or %s)",
+				op, operationCreate, operationUpdate)
+		}
+	}
+	return nil
+}
+
+func checkRulesOperations(r rulesConfig) error {
+	for _, i := range r.RestrictTolerations {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.RestrictNodeSelectors {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.RestrictNodeAffinity {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.PlacePods {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.Resources {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.DisableDaemonsets {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	for _, i := range r.NamespacesAddLabels {
+		if err := checkOperations(i.Operations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemOperations returns the operations a rule item runs on.
+func itemOperations(ops []string) []string {
+	if len(ops) == 0 {
+		return allOperations
+	}
+	return ops
+}
+
+// filterOperation keeps items that run on the operation.
+func filterOperation[T any](items []T, ops func(T) []string, op string) []T {
+	var list []T
+	for _, item := range items {
+		if slices.Contains(itemOperations(ops(item)), op) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// forOperation keeps only the rules that run on the admission operation.
+func (r rulesConfig) forOperation(op string) rulesConfig {
+	return rulesConfig{
+		Strategy: r.Strategy,
+		RestrictTolerations: filterOperation(r.RestrictTolerations,
+			func(i restrictTolerationConfig) []string { return i.Operations }, op),
+		RestrictNodeSelectors: filterOperation(r.RestrictNodeSelectors,
+			func(i restrictNodeSelectorConfig) []string { return i.Operations }, op),
+		RestrictNodeAffinity: filterOperation(r.RestrictNodeAffinity,
+			func(i restrictNodeAffinityConfig) []string { return i.Operations }, op),
+		PlacePods: filterOperation(r.PlacePods,
+			func(i placementConfig) []string { return i.Operations }, op),
+		Resources: filterOperation(r.Resources,
+			func(i setResource) []string { return i.Operations }, op),
+		DisableDaemonsets: filterOperation(r.DisableDaemonsets,
+			func(i selectDaemonset) []string { return i.Operations }, op),
+		NamespacesAddLabels: filterOperation(r.NamespacesAddLabels,
+			func(i nsAddLabels) []string { return i.Operations }, op),
+	}
+}
+
+// forPodOperation keeps only the rules that run on the pod admission
+// operation. Most of the pod spec is immutable after creation, so on pod
+// UPDATE, whatever the rule operations, only the tolerations of place_pods
+// apply, since tolerations can be added to a running pod, and the pod
+// annotations record the rules. restrict_tolerations, restrict_node_selectors
+// (like the accept_node_selectors default rule), restrict_node_affinity and
+// resources never run on pod UPDATE.
+// The pods/ephemeralcontainers subresource uses forEphemeralContainers().
+// Workload templates get the pod CREATE rules, see handleWorkload().
+func (r rulesConfig) forPodOperation(op string) rulesConfig {
+	r = r.forOperation(op)
+	if op != operationUpdate {
+		return r
+	}
+	update := rulesConfig{Strategy: r.Strategy}
+	for _, pc := range r.PlacePods {
+		// keep the placement, so that strategy first picks the same one
+		pc.Add = addConfig{Tolerations: pc.Add.Tolerations}
+		update.PlacePods = append(update.PlacePods, pc)
+	}
+	return update
+}
+
+// webhookOperations lists, per resource, the operations the webhook
+// must be registered for. A resource without operations is not registered.
+type webhookOperations struct {
+	pods                []admissionregistrationv1.OperationType
+	ephemeralContainers []admissionregistrationv1.OperationType // pods/ephemeralcontainers
+	workloads           []admissionregistrationv1.OperationType // pod templates, see workloadKinds
+	jobs                []admissionregistrationv1.OperationType // job pod template is immutable
+	daemonsets          []admissionregistrationv1.OperationType
+	namespaces          []admissionregistrationv1.OperationType
+}
+
+// rulesOperations collects the operations used by the rules.
+// With workloadTemplates, workloads are registered for CREATE and UPDATE,
+// since any template change gets the pod CREATE rules, except jobs,
+// registered only for CREATE.
+// Pods are always registered for CREATE because of the
+// ACCEPT_NODE_SELECTORS default rule, see acceptNodeSelectorsRules(),
+// which also covers the other pod rules, and for UPDATE only when
+// place_pods adds tolerations on UPDATE, see forPodOperation().
+// The ephemeralcontainers subresource is registered for UPDATE, the only
+// operation it supports, when env vars are added to ephemeral containers.
+func rulesOperations(list *rulesList, workloadTemplates bool) webhookOperations {
+	pods := []string{operationCreate}
+	var ephemeralContainers, daemonsets, namespaces []string
+
+	for _, r := range list.Rules {
+		for _, i := range r.PlacePods {
+			if len(i.Add.Tolerations) > 0 {
+				pods = append(pods, itemOperations(i.Operations)...)
+			}
+			if i.selectsEphemeral() &&
+				slices.Contains(itemOperations(i.Operations), operationUpdate) {
+				ephemeralContainers = append(ephemeralContainers, operationUpdate)
+			}
+		}
+		for _, i := range r.DisableDaemonsets {
+			daemonsets = append(daemonsets, itemOperations(i.Operations)...)
+		}
+		for _, i := range r.NamespacesAddLabels {
+			namespaces = append(namespaces, itemOperations(i.Operations)...)
+		}
+	}
+
+	ops := webhookOperations{
+		pods:                operationTypes(pods),
+		ephemeralContainers: operationTypes(ephemeralContainers),
+		daemonsets:          operationTypes(daemonsets),
+		namespaces:          operationTypes(namespaces),
+	}
+
+	if workloadTemplates {
+		ops.workloads = operationTypes(allOperations)
+		ops.jobs = operationTypes([]string{operationCreate})
+	}
+
+	return ops
+}
+
+// operationTypes removes duplicates and sorts, in order to produce
+// a stable webhook configuration.
+func operationTypes(ops []string) []admissionregistrationv1.OperationType {
+	var list []admissionregistrationv1.OperationType
+	for _, op := range allOperations {
+		if slices.Contains(ops, op) {
+			list = append(list, admissionregistrationv1.OperationType(op))
+		}
+	}
+	return list
+}
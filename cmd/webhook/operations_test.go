@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+const operationsRules = `
+rules:
+- place_pods:
+  - rule_name: create-only
+    operations: [CREATE]
+    add:
+      node_selector:
+        node: alpha
+  - rule_name: any-operation
+    add:
+      node_selector:
+        zone: a
+  namespaces_add_labels:
+  - rule_name: update-only
+    operations: [UPDATE]
+    name: ^default$
+    add_labels:
+      a: b
+`
+
+// go test -count 1 -run '^TestOperationsFilter$' ./cmd/webhook
+func TestOperationsFilter(t *testing.T) {
+	list, errRules := newRules([]byte(operationsRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	r := list.Rules[0]
+
+	create := r.forOperation(operationCreate)
+	if len(create.PlacePods) != 2 || len(create.NamespacesAddLabels) != 0 {
+		t.Errorf("CREATE: place_pods=%d namespaces_add_labels=%d",
+			len(create.PlacePods), len(create.NamespacesAddLabels))
+	}
+
+	update := r.forOperation(operationUpdate)
+	if len(update.PlacePods) != 1 || update.PlacePods[0].RuleName != "any-operation" {
+		t.Errorf("UPDATE: unexpected place_pods: %v", update.PlacePods)
+	}
+	if len(update.NamespacesAddLabels) != 1 {
+		t.Errorf("UPDATE: namespaces_add_labels=%d", len(update.NamespacesAddLabels))
+	}
+
+	if del := r.forOperation("DELETE"); !del.empty() {
+		t.Errorf("DELETE: expected no rules: %v", del)
+	}
+}
+
+const immutableRules = `
+rules:
+- restrict_tolerations:
+  - toleration:
+      key: ^spot$
+  restrict_node_selectors:
+  - node_selector:
+      key: ^pool$
+  restrict_node_affinity:
+  - expression:
+      key: ^pool$
+  place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        zone: a
+      priority_class_name: low
+      tolerations:
+      - key: dedicated
+        operator: Exists
+  resources:
+  - memory:
+      requests: 100Mi
+`
+
+// go test -count 1 -run '^TestPodOperationImmutable$' ./cmd/webhook
+func TestPodOperationImmutable(t *testing.T) {
+	list, errRules := newRules([]byte(immutableRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	r := list.Rules[0]
+
+	if create := r.forPodOperation(operationCreate); len(create.RestrictTolerations) != 1 ||
+		len(create.RestrictNodeSelectors) != 1 || len(create.RestrictNodeAffinity) != 1 ||
+		len(create.PlacePods) != 1 || len(create.Resources) != 1 {
+		t.Errorf("pod CREATE: unexpected rules: %v", create)
+	}
+
+	// rule items without operations run on both, but most of the pod
+	// spec is immutable: only tolerations can be added
+	update := r.forPodOperation(operationUpdate)
+	if len(update.RestrictTolerations) != 0 || len(update.RestrictNodeSelectors) != 0 ||
+		len(update.RestrictNodeAffinity) != 0 || len(update.Resources) != 0 {
+		t.Errorf("pod UPDATE: restrict_tolerations=%d restrict_node_selectors=%d restrict_node_affinity=%d resources=%d",
+			len(update.RestrictTolerations), len(update.RestrictNodeSelectors),
+			len(update.RestrictNodeAffinity), len(update.Resources))
+	}
+	if len(update.PlacePods) != 1 {
+		t.Fatalf("pod UPDATE: place_pods=%d", len(update.PlacePods))
+	}
+	add := update.PlacePods[0].Add
+	if len(add.NodeSelector) != 0 || add.PriorityClassName != "" || len(add.Tolerations) != 1 {
+		t.Errorf("pod UPDATE: place_pods add: node_selector=%v priority_class_name=%q tolerations=%d",
+			add.NodeSelector, add.PriorityClassName, len(add.Tolerations))
+	}
+
+	// workload templates get the pod CREATE rules on any operation
+	if template := r.forOperation(operationCreate); len(template.RestrictNodeSelectors) != 1 ||
+		len(template.RestrictNodeAffinity) != 1 {
+		t.Errorf("template UPDATE: restrict_node_selectors=%d restrict_node_affinity=%d",
+			len(template.RestrictNodeSelectors), len(template.RestrictNodeAffinity))
+	}
+}
+
+// go test -count 1 -run '^TestOperationsBad$' ./cmd/webhook
+func TestOperationsBad(t *testing.T) {
+	const input = `
+rules:
+- resources:
+  - operations: [CREATE, create]
+`
+	if _, err := newRules([]byte(input), true); err == nil {
+		t.Errorf("expected error for bad operation, got nil")
+	}
+}
+
+type webhookRulesTestCase struct {
+	name              string
+	rules             string
+	workloadTemplates bool
+	expected          string
+}
+
+var webhookRulesTestTable = []webhookRulesTestCase{
+	{
+		name:     "no rules registers pods for CREATE",
+		rules:    `rules: []`,
+		expected: "pods:[CREATE]",
+	},
+	{
+		name:     "operations in use",
+		rules:    operationsRules,
+		expected: "pods:[CREATE] namespaces:[UPDATE]",
+	},
+	{
+		name: "tolerations register pods for UPDATE",
+		rules: `
+rules:
+- place_pods:
+  - add:
+      tolerations:
+      - key: dedicated
+        operator: Exists
+  - operations: [CREATE]
+    add:
+      node_selector:
+        zone: a
+`,
+		expected: "pods:[CREATE UPDATE]",
+	},
+	{
+		name: "tolerations only on create",
+		rules: `
+rules:
+- place_pods:
+  - operations: [CREATE]
+    add:
+      tolerations:
+      - key: dedicated
+        operator: Exists
+- restrict_tolerations:
+  - toleration:
+      key: ^spot$
+  resources:
+  - memory:
+      requests: 100Mi
+`,
+		expected: "pods:[CREATE]",
+	},
+	{
+		name: "daemonset rule without operations",
+		rules: `
+rules:
+- disable_daemonsets:
+  - name: ^ds1$
+    node_selector:
+      x: y
+`,
+		expected: "pods:[CREATE] daemonsets:[CREATE UPDATE]",
+	},
+	{
+		name:              "workload templates",
+		rules:             operationsRules,
+		workloadTemplates: true,
+		expected:          "pods:[CREATE] deployments:[CREATE UPDATE] statefulsets:[CREATE UPDATE] replicasets:[CREATE UPDATE] jobs:[CREATE] cronjobs:[CREATE UPDATE] namespaces:[UPDATE]",
+	},
+	{
+		name:              "workload templates register UPDATE without pod UPDATE rules",
+		rules:             `rules: []`,
+		workloadTemplates: true,
+		expected:          "pods:[CREATE] deployments:[CREATE UPDATE] statefulsets:[CREATE UPDATE] replicasets:[CREATE UPDATE] jobs:[CREATE] cronjobs:[CREATE UPDATE]",
+	},
+	{
+		name: "restrict_node_selectors registers pods only for CREATE",
+		rules: `
+rules:
+- restrict_node_selectors:
+  - node_selector:
+      key: ^pool$
+`,
+		expected: "pods:[CREATE]",
+	},
+	{
+		name: "restrict_node_affinity registers pods only for CREATE",
+		rules: `
+rules:
+- restrict_node_affinity:
+  - expression:
+      key: ^pool$
+`,
+		expected: "pods:[CREATE]",
+	},
+	{
+		name: "env for ephemeral containers",
+		rules: `
+rules:
+- place_pods:
+  - add:
+      containers:
+        debugger:
+          container_types: [ephemeral]
+          env:
+          - name: HTTP_PROXY
+            value: proxy:3128
+`,
+		expected: "pods:[CREATE] pods/ephemeralcontainers:[UPDATE]",
+	},
+	{
+		name: "env for ephemeral containers only on create",
+		rules: `
+rules:
+- place_pods:
+  - operations: [CREATE]
+    add:
+      containers:
+        debugger:
+          container_types: [ephemeral]
+          env:
+          - name: HTTP_PROXY
+            value: proxy:3128
+`,
+		expected: "pods:[CREATE]",
+	},
+}
+
+// go test -count 1 -run '^TestWebhookRules$' ./cmd/webhook
+func TestWebhookRules(t *testing.T) {
+	for i, data := range webhookRulesTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(webhookRulesTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			list, errRules := newRules([]byte(data.rules), true)
+			if errRules != nil {
+				t.Fatalf("rules: %v", errRules)
+			}
+			var got string
+			for _, r := range webhookRules(rulesOperations(&list, data.workloadTemplates)) {
+				if got != "" {
+					got += " "
+				}
+				got += fmt.Sprintf("%s:%v", r.Resources[0], r.Operations)
+			}
+			if got != data.expected {
+				t.Errorf("got=%s expected=%s", got, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestRulesStoreSubscribe$' ./cmd/webhook
+func TestRulesStoreSubscribe(t *testing.T) {
+	store := &rulesStore{}
+	changed := store.subscribe()
+
+	store.setCRDRules(nil, nil)
+	store.setCRDRules(nil, nil) // coalesced with pending notification
+
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("expected notification")
+	}
+
+	select {
+	case <-changed:
+		t.Errorf("unexpected second notification")
+	default:
+	}
+
+	// every subscriber is notified
+	first := store.subscribe()
+	second := store.subscribe()
+	store.setCRDRules(nil, nil)
+	for i, c := range []<-chan struct{}{first, second} {
+		select {
+		case <-c:
+		default:
+			t.Errorf("subscriber %d: expected notification", i+1)
+		}
+	}
+}
+
+type podUpdateTestCase struct {
+	name        string
+	subResource string
+	expected    string
+}
+
+var podUpdateTestTable = []podUpdateTestCase{
+	{
+		name:     "pod UPDATE only adds tolerations",
+		expected: `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"rules[0].place_pods[0]","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"add","path":"/spec/tolerations","value":[{"key":"dedicated","operator":"Exists"}]}]`,
+	},
+	{
+		name:        "ephemeralcontainers subresource",
+		subResource: subresourceEphemeralContainers,
+		expected:    `[{"op":"add","path":"/spec/ephemeralContainers/0/env","value":[{"name":"ENV1","value":"VALUE1"}]}]`,
+	},
+}
+
+// go test -count 1 -run '^TestPodUpdate$' ./cmd/webhook
+func TestPodUpdate(t *testing.T) {
+
+	const rules = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        zone: a
+      priority_class_name: low
+      tolerations:
+      - key: dedicated
+        operator: Exists
+      containers:
+        debugger:
+          container_types: [ephemeral]
+          env:
+          - name: ENV1
+            value: VALUE1
+  resources:
+  - memory:
+      requests: 100Mi
+`
+
+	const pod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"pod-1","namespace":"default"},"spec":{"containers":[{"name":"app"}],"ephemeralContainers":[{"name":"debugger"}],"priority":0,"priorityClassName":"high"}}`
+
+	store := &rulesStore{}
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if _, err := store.reload(path, true); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	app := &application{
+		codecs: serializer.NewCodecFactory(runtime.NewScheme()),
+		rules:  store,
+	}
+
+	for i, data := range podUpdateTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(podUpdateTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			resp := admissionResponse(t, app, &admissionv1.AdmissionRequest{
+				UID:         "uid-1",
+				Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+				SubResource: data.subResource,
+				Namespace:   "default",
+				Operation:   admissionv1.Update,
+				Object:      runtime.RawExtension{Raw: []byte(pod)},
+			})
+
+			expected := strings.ReplaceAll(data.expected, "HASH", store.get().hash)
+			if got := string(resp.Patch); got != expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+// orderRules flattens the rule groups into a single rules section, with
+// the items of each rule kind in evaluation order: higher priority first,
+// then order of appearance (rule groups, then items in the group).
+//
+// Placement, daemonset and namespace items remember their rule group,
+// so that strategy first still applies at most one item per rule group.
+func orderRules(groups []rulesConfig) rulesConfig {
+	var ordered rulesConfig
+
+	for g, r := range groups {
+		ordered.RestrictTolerations = append(ordered.RestrictTolerations,
+			r.RestrictTolerations...)
+		ordered.RestrictNodeSelectors = append(ordered.RestrictNodeSelectors,
+			r.RestrictNodeSelectors...)
+		ordered.RestrictNodeAffinity = append(ordered.RestrictNodeAffinity,
+			r.RestrictNodeAffinity...)
+		for _, pc := range r.PlacePods {
+			pc.group = g
+			pc.strategy = r.Strategy
+			ordered.PlacePods = append(ordered.PlacePods, pc)
+		}
+		ordered.Resources = append(ordered.Resources, r.Resources...)
+		for _, ds := range r.DisableDaemonsets {
+			ds.group = g
+			ds.strategy = r.Strategy
+			ordered.DisableDaemonsets = append(ordered.DisableDaemonsets, ds)
+		}
+		for _, ns := range r.NamespacesAddLabels {
+			ns.group = g
+			ns.strategy = r.Strategy
+			ordered.NamespacesAddLabels = append(ordered.NamespacesAddLabels, ns)
+		}
+	}
+
+	sortByPriority(ordered.RestrictTolerations,
+		func(i restrictTolerationConfig) int { return i.Priority })
+	sortByPriority(ordered.RestrictNodeSelectors,
+		func(i restrictNodeSelectorConfig) int { return i.Priority })
+	sortByPriority(ordered.RestrictNodeAffinity,
+		func(i restrictNodeAffinityConfig) int { return i.Priority })
+	sortByPriority(ordered.PlacePods,
+		func(i placementConfig) int { return i.Priority })
+	sortByPriority(ordered.Resources,
+		func(i setResource) int { return i.Priority })
+	sortByPriority(ordered.DisableDaemonsets,
+		func(i selectDaemonset) int { return i.Priority })
+	sortByPriority(ordered.NamespacesAddLabels,
+		func(i nsAddLabels) int { return i.Priority })
+
+	return ordered
+}
+
+// sortByPriority sorts by descending priority, keeping the order
+// of items with the same priority.
+func sortByPriority[T any](items []T, priority func(T) int) {
+	slices.SortStableFunc(items, func(a, b T) int {
+		return cmp.Compare(priority(b), priority(a))
+	})
+}
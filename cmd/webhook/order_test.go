@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const orderRulesInput = `
+rules:
+# tenant defaults
+- place_pods:
+  - rule_name: tenant-default
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: tenant
+      priority_class_name: low
+  resources:
+  - rule_name: tenant-memory
+    memory:
+      requests: 100Mi
+# platform override, after tenant defaults in the file
+- place_pods:
+  - rule_name: platform-override
+    priority: 100
+    final: true
+    pods:
+      - namespace: ^platform$
+    add:
+      node_selector:
+        pool: platform
+  - rule_name: platform-spot
+    priority: 10
+    pods:
+      - namespace: ^platform$
+    add:
+      tolerations:
+        - key: spot
+          operator: Exists
+  resources:
+  - rule_name: platform-memory
+    priority: 100
+    final: true
+    pod:
+      namespace: ^platform$
+    memory:
+      requests: 1Gi
+  restrict_tolerations:
+  - rule_name: platform-gpu
+    priority: 100
+    final: true
+    toleration:
+      key: ^gpu$
+    allowed_pods:
+      - namespace: ^platform$
+- restrict_tolerations:
+  - rule_name: no-gpu
+    toleration:
+      key: ^gpu$
+    allowed_pods:
+      - namespace: ^nobody$
+`
+
+// go test -count 1 -run '^TestOrderRules$' ./cmd/webhook
+func TestOrderRules(t *testing.T) {
+	list, errRules := newRules([]byte(orderRulesInput), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	var got []string
+	for _, pc := range list.ordered.PlacePods {
+		got = append(got, fmt.Sprintf("%s/%d", pc.RuleName, pc.group))
+	}
+	for _, r := range list.ordered.Resources {
+		got = append(got, r.RuleName)
+	}
+	for _, r := range list.ordered.RestrictTolerations {
+		got = append(got, r.RuleName)
+	}
+
+	const expected = "[platform-override/1 platform-spot/1 tenant-default/0 platform-memory tenant-memory platform-gpu no-gpu]"
+
+	if str := fmt.Sprintf("%v", got); str != expected {
+		t.Errorf("\n==      got:%s\n== expected:%s", str, expected)
+	}
+}
+
+// go test -count 1 -run '^TestOrderFinal$' ./cmd/webhook
+func TestOrderFinal(t *testing.T) {
+	list, errRules := newRules([]byte(orderRulesInput), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+	r := list.ordered
+
+	containers := []corev1.Container{{Name: "app"}}
+	tolerations := []corev1.Toleration{{Key: "gpu", Operator: "Exists"}}
+
+	for _, data := range []struct {
+		namespace   string
+		placement   string
+		resources   string
+		tolerations string
+	}{
+		{
+			namespace:   "platform",
+			placement:   `[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"platform"}}] [platform-override]`,
+			resources:   `[{"op":"add","path":"/spec/containers/0/resources/requests","value":{"memory":"1Gi"}}] [platform-memory]`,
+			tolerations: `[] []`,
+		},
+		{
+			namespace: "tenant",
+			placement: `[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"tenant"}} {"op":"add","path":"/spec/priorityClassName","value":"low"}] [tenant-default]`,
+			resources: `[{"op":"add","path":"/spec/containers/0/resources/requests","value":{"memory":"100Mi"}}] [tenant-memory]`,
+			// removed by the final platform rule, before no-gpu
+			tolerations: `[0] [platform-gpu]`,
+		},
+	} {
+		pod := podInfo{namespace: data.namespace, name: "pod-1", containers: containers}
+
+		obj := corev1.Pod{Spec: corev1.PodSpec{Containers: containers}}
+
+		mutated := obj.DeepCopy()
+		placementFired := addPlacement(pod, &mutated.Spec, r.PlacePods)
+		if got := diffString(t, &obj, mutated) + fmt.Sprintf(" %v", placementFired); got != data.placement {
+			t.Errorf("%s: placement:\n==      got:%s\n== expected:%s",
+				data.namespace, got, data.placement)
+		}
+
+		mutated = obj.DeepCopy()
+		resourcesFired := addResource(pod, &mutated.Spec, r.Resources, false)
+		if got := diffString(t, &obj, mutated) + fmt.Sprintf(" %v", resourcesFired); got != data.resources {
+			t.Errorf("%s: resources:\n==      got:%s\n== expected:%s",
+				data.namespace, got, data.resources)
+		}
+
+		removed, removedFired := removeTolerationsIndices(pod, tolerations,
+			r.RestrictTolerations)
+		if got := fmt.Sprintf("%v %v", removed, removedFired); got != data.tolerations {
+			t.Errorf("%s: tolerations:\n==      got:%s\n== expected:%s",
+				data.namespace, got, data.tolerations)
+		}
+	}
+}
+
+// go test -count 1 -run '^TestOrderMergePriority$' ./cmd/webhook
+func TestOrderMergePriority(t *testing.T) {
+	const input = `
+rules:
+- strategy: merge
+  place_pods:
+  - rule_name: default
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: default
+        zone: a
+      priority_class_name: low
+  - rule_name: override
+    priority: 10
+    pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: override
+      priority_class_name: high
+`
+	list, errRules := newRules([]byte(input), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	pod := podInfo{namespace: "default", name: "pod-1"}
+
+	var obj corev1.Pod
+	mutated := obj.DeepCopy()
+	fired := addPlacement(pod, &mutated.Spec, list.ordered.PlacePods)
+
+	const expected = `[{"op":"add","path":"/spec/nodeSelector","value":{"pool":"override","zone":"a"}} {"op":"add","path":"/spec/priorityClassName","value":"high"}] [override default]`
+
+	if got := diffString(t, &obj, mutated) + fmt.Sprintf(" %v", fired); got != expected {
+		t.Errorf("\n==      got:%s\n== expected:%s", got, expected)
+	}
+}
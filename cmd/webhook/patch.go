@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// patchOp is one RFC 6902 JSON patch operation.
+type patchOp struct {
+	Op    string
+	Path  string
+	Value any
+}
+
+func patchAdd(path string, value any) patchOp {
+	return patchOp{Op: "add", Path: path, Value: value}
+}
+
+func patchReplace(path string, value any) patchOp {
+	return patchOp{Op: "replace", Path: path, Value: value}
+}
+
+func patchRemove(path string) patchOp {
+	return patchOp{Op: "remove", Path: path}
+}
+
+// jsonPointer builds a JSON pointer from unescaped path segments.
+func jsonPointer(segments ...string) string {
+	var sb strings.Builder
+	for _, s := range segments {
+		sb.WriteByte('/')
+		sb.WriteString(escapeJSONPointer(s))
+	}
+	return sb.String()
+}
+
+// splitJSONPointer returns the unescaped segments of a JSON pointer.
+func splitJSONPointer(path string) []string {
+	if path == "" {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, s := range segments {
+		s = strings.ReplaceAll(s, "~1", "/")
+		segments[i] = strings.ReplaceAll(s, "~0", "~")
+	}
+	return segments
+}
+
+// MarshalJSON keeps the field order op, path, value,
+// and omits the value for operations that do not take one.
+func (op patchOp) MarshalJSON() ([]byte, error) {
+	path, errPath := json.Marshal(op.Path)
+	if errPath != nil {
+		return nil, errPath
+	}
+	var sb strings.Builder
+	sb.WriteString(`{"op":"`)
+	sb.WriteString(op.Op)
+	sb.WriteString(`","path":`)
+	sb.Write(path)
+	switch op.Op {
+	case "add", "replace":
+		value, errValue := json.Marshal(op.Value)
+		if errValue != nil {
+			return nil, fmt.Errorf("patch %s %s: %v", op.Op, op.Path, errValue)
+		}
+		sb.WriteString(`,"value":`)
+		sb.Write(value)
+	}
+	sb.WriteByte('}')
+	return []byte(sb.String()), nil
+}
+
+func (op patchOp) String() string {
+	data, err := op.MarshalJSON()
+	if err != nil {
+		return fmt.Sprintf("<bad patch: %v>", err)
+	}
+	return string(data)
+}
+
+// buildPatch turns the operations into the JSON patch for the original
+// object. It walks the operations over a copy of the object in order to:
+//
+//   - add missing parent maps and arrays before an operation needs them,
+//   - turn a replace of a missing member into an add,
+//   - drop the removal of a missing member.
+//
+// The resulting patch is applied to the original object before it is
+// returned, so that a broken patch is reported here instead of by the
+// api-server.
+func buildPatch(original []byte, ops []patchOp) ([]byte, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	var doc any
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, fmt.Errorf("buildPatch: decode object: %v", err)
+	}
+
+	var list []patchOp
+
+	for _, op := range ops {
+		segments := splitJSONPointer(op.Path)
+		if len(segments) == 0 {
+			return nil, fmt.Errorf("buildPatch: %s: empty path", op)
+		}
+
+		// add missing parents
+		for k := 1; k < len(segments); k++ {
+			if _, found := lookupJSON(doc, segments[:k]); found {
+				continue
+			}
+			isArray := segments[k] == "-" || isArrayIndex(segments[k])
+			add := patchAdd(jsonPointer(segments[:k]...), emptyJSON(isArray))
+			updated, errApply := applyJSON(doc, segments[:k], add.Op,
+				emptyJSON(isArray)) // the document must not share the patch value
+			if errApply != nil {
+				return nil, fmt.Errorf("buildPatch: %s: %v", add, errApply)
+			}
+			doc = updated
+			list = append(list, add)
+		}
+
+		_, found := lookupJSON(doc, segments)
+		switch {
+		case op.Op == "replace" && !found:
+			op.Op = "add"
+		case op.Op == "remove" && !found:
+			log.Printf("buildPatch: %s: missing path, dropped", op)
+			continue
+		}
+
+		value, errValue := normalizeJSON(op.Value)
+		if errValue != nil {
+			return nil, fmt.Errorf("buildPatch: %s: %v", op.Path, errValue)
+		}
+		updated, errApply := applyJSON(doc, segments, op.Op, value)
+		if errApply != nil {
+			return nil, fmt.Errorf("buildPatch: %s: %v", op, errApply)
+		}
+		doc = updated
+		list = append(list, op)
+	}
+
+	data, errJSON := json.Marshal(list)
+	if errJSON != nil {
+		return nil, fmt.Errorf("buildPatch: encode patch: %v", errJSON)
+	}
+
+	patch, errDecode := jsonpatch.DecodePatch(data)
+	if errDecode != nil {
+		return nil, fmt.Errorf("buildPatch: decode patch: %v: %s", errDecode, data)
+	}
+	if _, err := patch.Apply(original); err != nil {
+		return nil, fmt.Errorf("buildPatch: apply patch: %v: %s", err, data)
+	}
+
+	return data, nil
+}
+
+// setPatch builds the patch from the original object to the mutated one
+// and attaches it to the response. If the patch cannot be built,
+// the object is admitted unchanged with a warning.
+func setPatch(admissionResponse *admissionv1.AdmissionResponse,
+	request *admissionv1.AdmissionRequest, name string,
+	original, mutated any, debug bool) {
+
+	patch, errPatch := objectPatch(request, original, mutated)
+	if errPatch != nil {
+		log.Printf("ERROR: setPatch: %s/%s: %v", request.Namespace, name, errPatch)
+		admissionResponse.Warnings = append(admissionResponse.Warnings,
+			fmt.Sprintf("mutating webhook: patch not applied: %v", errPatch))
+		return
+	}
+
+	if debug {
+		log.Printf("DEBUG setPatch: %s/%s: patch: '%s'",
+			request.Namespace, name, patch)
+	}
+
+	if len(patch) == 0 {
+		return
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	admissionResponse.PatchType = &patchType
+	admissionResponse.Patch = patch
+}
+
+// objectPatch diffs the objects and builds the patch against
+// the object in the admission request.
+func objectPatch(request *admissionv1.AdmissionRequest,
+	original, mutated any) ([]byte, error) {
+	list, errDiff := diffPatch(original, mutated)
+	if errDiff != nil {
+		return nil, errDiff
+	}
+	return buildPatch(request.Object.Raw, list)
+}
+
+func emptyJSON(isArray bool) any {
+	if isArray {
+		return []any{}
+	}
+	return map[string]any{}
+}
+
+func isArrayIndex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeJSON converts a value to the generic form of decoded JSON,
+// so that later operations can walk into it.
+func normalizeJSON(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n any
+	err = json.Unmarshal(data, &n)
+	return n, err
+}
+
+// lookupJSON finds the value at the path.
+// A null member is reported as missing.
+func lookupJSON(doc any, segments []string) (any, bool) {
+	node := doc
+	for _, s := range segments {
+		switch n := node.(type) {
+		case map[string]any:
+			child, found := n[s]
+			if !found {
+				return nil, false
+			}
+			node = child
+		case []any:
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, node != nil
+}
+
+// applyJSON applies one operation at the path and returns the updated node.
+func applyJSON(node any, segments []string, op string, value any) (any, error) {
+	key := segments[0]
+
+	if len(segments) > 1 {
+		child, found := lookupJSON(node, segments[:1])
+		if !found {
+			return nil, fmt.Errorf("missing member: %s", key)
+		}
+		updated, err := applyJSON(child, segments[1:], op, value)
+		if err != nil {
+			return nil, err
+		}
+		switch n := node.(type) {
+		case map[string]any:
+			n[key] = updated
+		case []any:
+			i, _ := strconv.Atoi(key)
+			n[i] = updated
+		}
+		return node, nil
+	}
+
+	switch n := node.(type) {
+	case map[string]any:
+		switch op {
+		case "add", "replace":
+			n[key] = value
+		case "remove":
+			delete(n, key)
+		default:
+			return nil, fmt.Errorf("unsupported operation: %s", op)
+		}
+		return n, nil
+	case []any:
+		if key == "-" && op == "add" {
+			return append(n, value), nil
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i > len(n) || (i == len(n) && op != "add") {
+			return nil, fmt.Errorf("bad array index: %s", key)
+		}
+		switch op {
+		case "add":
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+		case "replace":
+			n[i] = value
+		case "remove":
+			n = append(n[:i], n[i+1:]...)
+		default:
+			return nil, fmt.Errorf("unsupported operation: %s", op)
+		}
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("not a map or array at: %s", key)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type patchTestCase struct {
+	name     string
+	original string
+	ops      []patchOp
+	expected string
+}
+
+var patchTestTable = []patchTestCase{
+	{
+		name:     "no operations",
+		original: `{}`,
+		expected: ``,
+	},
+	{
+		name:     "escape toleration value",
+		original: `{"spec":{"tolerations":[]}}`,
+		ops: []patchOp{patchAdd("/spec/tolerations/-",
+			corev1.Toleration{Key: "k", Operator: "Equal", Value: `a"b`, Effect: "NoSchedule"})},
+		expected: `[{"op":"add","path":"/spec/tolerations/-","value":{"key":"k","operator":"Equal","value":"a\"b","effect":"NoSchedule"}}]`,
+	},
+	{
+		name:     "create missing tolerations array",
+		original: `{"spec":{}}`,
+		ops: []patchOp{
+			patchAdd("/spec/tolerations/-", corev1.Toleration{Key: "k1", Operator: "Exists"}),
+			patchAdd("/spec/tolerations/-", corev1.Toleration{Key: "k2", Operator: "Exists"}),
+		},
+		expected: `[{"op":"add","path":"/spec/tolerations","value":[]},{"op":"add","path":"/spec/tolerations/-","value":{"key":"k1","operator":"Exists"}},{"op":"add","path":"/spec/tolerations/-","value":{"key":"k2","operator":"Exists"}}]`,
+	},
+	{
+		name:     "create null tolerations array",
+		original: `{"spec":{"tolerations":null}}`,
+		ops: []patchOp{patchAdd("/spec/tolerations/-",
+			corev1.Toleration{Key: "k1", Operator: "Exists"})},
+		expected: `[{"op":"add","path":"/spec/tolerations","value":[]},{"op":"add","path":"/spec/tolerations/-","value":{"key":"k1","operator":"Exists"}}]`,
+	},
+	{
+		name:     "create missing maps",
+		original: `{"metadata":{"name":"pod-1"}}`,
+		ops:      []patchOp{patchAdd("/metadata/annotations/a~1b", "c")},
+		expected: `[{"op":"add","path":"/metadata/annotations","value":{}},{"op":"add","path":"/metadata/annotations/a~1b","value":"c"}]`,
+	},
+	{
+		name:     "replace missing member",
+		original: `{"spec":{"containers":[{"name":"c1"}]}}`,
+		ops: []patchOp{
+			patchReplace("/spec/containers/0/resources/requests", map[string]string{"cpu": "1"}),
+			patchReplace("/spec/containers/0/resources/limits", map[string]string{"cpu": "2"}),
+		},
+		expected: `[{"op":"add","path":"/spec/containers/0/resources","value":{}},{"op":"add","path":"/spec/containers/0/resources/requests","value":{"cpu":"1"}},{"op":"add","path":"/spec/containers/0/resources/limits","value":{"cpu":"2"}}]`,
+	},
+	{
+		name:     "replace existing member",
+		original: `{"spec":{"containers":[{"name":"c1","resources":{"requests":{"cpu":"500m"}}}]}}`,
+		ops:      []patchOp{patchReplace("/spec/containers/0/resources/requests", map[string]string{"cpu": "1"})},
+		expected: `[{"op":"replace","path":"/spec/containers/0/resources/requests","value":{"cpu":"1"}}]`,
+	},
+	{
+		name:     "remove missing member",
+		original: `{"spec":{"nodeSelector":{"a":"1"}}}`,
+		ops: []patchOp{
+			patchRemove("/spec/nodeSelector/a"),
+			patchRemove("/spec/nodeSelector/b"),
+			patchRemove("/spec/priority"),
+		},
+		expected: `[{"op":"remove","path":"/spec/nodeSelector/a"}]`,
+	},
+	{
+		name:     "remove tolerations in descending order",
+		original: `{"spec":{"tolerations":[{"key":"a"},{"key":"b"},{"key":"c"}]}}`,
+		ops:      []patchOp{patchRemove("/spec/tolerations/2"), patchRemove("/spec/tolerations/0")},
+		expected: `[{"op":"remove","path":"/spec/tolerations/2"},{"op":"remove","path":"/spec/tolerations/0"}]`,
+	},
+	{
+		name:     "created parent is reused",
+		original: `{"spec":{"containers":[{"name":"c1"}]}}`,
+		ops: []patchOp{
+			patchAdd("/spec/containers/0/env/-", map[string]string{"name": "A", "value": "1"}),
+			patchAdd("/spec/containers/0/env/-", map[string]string{"name": "B", "value": "2"}),
+		},
+		expected: `[{"op":"add","path":"/spec/containers/0/env","value":[]},{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"A","value":"1"}},{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"B","value":"2"}}]`,
+	},
+}
+
+// go test -count 1 -run '^TestBuildPatch$' ./cmd/webhook
+func TestBuildPatch(t *testing.T) {
+	for i, data := range patchTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(patchTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			patch, errPatch := buildPatch([]byte(data.original), data.ops)
+			if errPatch != nil {
+				t.Fatalf("unexpected error: %v", errPatch)
+			}
+			if got := string(patch); got != data.expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestBuildPatchErrors$' ./cmd/webhook
+func TestBuildPatchErrors(t *testing.T) {
+	for _, data := range []struct {
+		original string
+		op       patchOp
+	}{
+		{`{"spec":{"containers":[]}}`, patchAdd("/spec/containers/3/env/-", "x")},
+		{`{"spec":{"priority":1}}`, patchAdd("/spec/priority/a", "x")},
+		{`{"spec":{}}`, patchAdd("", "x")},
+		{`not json`, patchAdd("/spec/priority", 1)},
+	} {
+		if _, err := buildPatch([]byte(data.original), []patchOp{data.op}); err == nil {
+			t.Errorf("expected error: original=%s op=%s", data.original, data.op)
+		}
+	}
+}
@@ -14,6 +14,21 @@ func (p *pattern) matchString(s string) bool {
 	return p.negate != p.re.MatchString(s)
 }
 
+// matchAny reports whether the pattern matches any string in the list.
+// A negated pattern matches only if no string in the list matches the
+// expression. An empty list is matched as the empty string.
+func (p *pattern) matchAny(list []string) bool {
+	if len(list) == 0 {
+		return p.matchString("")
+	}
+	for _, s := range list {
+		if p.re.MatchString(s) {
+			return !p.negate
+		}
+	}
+	return p.negate
+}
+
 const patternNegatePrefix = "_"
 
 func patternCompile(s string) (*pattern, error) {
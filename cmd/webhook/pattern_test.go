@@ -77,3 +77,31 @@ func TestNegatePattern(t *testing.T) {
 		}
 	}
 }
+
+// go test -count 1 -run '^TestPatternMatchAny$' ./cmd/webhook
+func TestPatternMatchAny(t *testing.T) {
+	table := []struct {
+		expr     string
+		list     []string
+		expected bool
+	}{
+		{"", nil, true},
+		{"", []string{"a"}, true},
+		{"^ci$", nil, false},
+		{"^ci$", []string{"dev", "ci"}, true},
+		{"^ci$", []string{"dev", "ops"}, false},
+		{"_^ci$", nil, true},
+		{"_^ci$", []string{"dev", "ci"}, false},
+		{"_^ci$", []string{"dev", "ops"}, true},
+	}
+	for i, data := range table {
+		p, errCompile := patternCompile(data.expr)
+		if errCompile != nil {
+			t.Fatalf("%d: compile error '%s': %v", i, data.expr, errCompile)
+		}
+		if m := p.matchAny(data.list); m != data.expected {
+			t.Errorf("%d: expr='%s' list=%v: got=%t expected=%t",
+				i, data.expr, data.list, m, data.expected)
+		}
+	}
+}
@@ -3,36 +3,39 @@ package main
 import (
 	"fmt"
 	"log"
+	"maps"
+	"math"
+	"regexp"
 	"slices"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func removeTolerations(namespace, podName, priorityClassName string,
-	podLabels map[string]string, podOwnerReferences []metav1.OwnerReference,
-	podTolerations []corev1.Toleration,
+// removeTolerations removes the restricted tolerations from the pod spec.
+// It returns the rules that removed tolerations.
+func removeTolerations(pod podInfo, spec *corev1.PodSpec,
 	restrictToleration []restrictTolerationConfig) []string {
 
-	toRemove := removeTolerationsIndices(namespace, podName,
-		priorityClassName, podLabels, podOwnerReferences, podTolerations,
+	toRemove, fired := removeTolerationsIndices(pod, spec.Tolerations,
 		restrictToleration)
 
-	// build patch list removing all tolerations by index
-	list := make([]string, 0, len(toRemove))
-	for _, i := range toRemove {
-		list = append(list, fmt.Sprintf(`{"op":"remove","path":"/spec/tolerations/%d"}`, i))
+	if len(toRemove) == 0 {
+		return nil
 	}
-	return list
+
+	for _, i := range toRemove { // indices are in descending order
+		spec.Tolerations = slices.Delete(spec.Tolerations, i, i+1)
+	}
+
+	return fired
 }
 
-func removeTolerationsIndices(namespace, podName, priorityClassName string,
-	podLabels map[string]string,
-	podOwnerReferences []metav1.OwnerReference,
-	podTolerations []corev1.Toleration,
-	restrictToleration []restrictTolerationConfig) []int {
+func removeTolerationsIndices(pod podInfo, podTolerations []corev1.Toleration,
+	restrictToleration []restrictTolerationConfig) ([]int, []string) {
 
 	var toRemove []int // list of tolerations index to remove
+	var fired []string // rules that removed tolerations
 
 	size := len(podTolerations)
 	removed := make([]bool, size) // report only: tolerations removed
@@ -57,8 +60,7 @@ func removeTolerationsIndices(namespace, podName, priorityClassName string,
 			var isAllowed bool
 			podRule := -1
 			for k, allowedPod := range rt.AllowedPods {
-				if allowedPod.match(namespace, podName, priorityClassName,
-					podLabels, podOwnerReferences) {
+				if allowedPod.match(pod) {
 					isAllowed = true
 					podRule = k
 					break
@@ -70,8 +72,9 @@ func removeTolerationsIndices(namespace, podName, priorityClassName string,
 				//
 				toRemove = append(toRemove, i) // add to remove list
 				removed[i] = true
-				track[i] = fmt.Sprintf("[tolerationRule=%d/%d]",
-					j, len(restrictToleration)) // explain removal
+				track[i] = fmt.Sprintf("[tolerationRule=%d/%d rule=%s]",
+					j, len(restrictToleration), rt.id) // explain removal
+				fired = addFired(fired, rt.id)
 
 				// stop checking pt against restricted tolerations
 				break
@@ -79,6 +82,12 @@ func removeTolerationsIndices(namespace, podName, priorityClassName string,
 
 			track[i] = fmt.Sprintf("[tolerationRule=%d/%d podRule=%d/%d]",
 				j, len(restrictToleration), podRule, len(rt.AllowedPods)) // explain acceptance
+
+			if rt.Final {
+				// pod allowed by final rule, skip remaining rules
+				track[i] += " [final]"
+				break
+			}
 		}
 	}
 
@@ -87,27 +96,93 @@ func removeTolerationsIndices(namespace, podName, priorityClassName string,
 		tol := tolerationToString(podTolerations[i])
 		trk := track[i]
 		log.Printf("pod: %s/%s: toleration=%s: removed=%t %s",
-			namespace, podName, tol, rem, trk)
+			pod.namespace, pod.name, tol, rem, trk)
 	}
 
-	return toRemove
+	return toRemove, fired
 }
 
-func removeNodeSelectors(namespace, podName string, nodeSelector map[string]string, acceptSelectors []string) []string {
-	var toRemove []string
+// removeNodeSelectors removes the restricted nodeSelector keys from the
+// pod spec, in sorted key order. Like tolerations, a key is removed by the
+// first rule that matches it and does not allow the pod, unless a final
+// rule allowing the pod comes first.
+// It returns the rules that removed keys.
+func removeNodeSelectors(pod podInfo, spec *corev1.PodSpec,
+	restrictNodeSelector []restrictNodeSelectorConfig) []string {
+
+	var fired []string // rules that removed keys
+
+	for _, key := range slices.Sorted(maps.Keys(spec.NodeSelector)) {
+		value := spec.NodeSelector[key]
+
+		var removed bool
+		track := "[no node selector rule matched]"
+
+		for j, rn := range restrictNodeSelector {
+
+			if isRestricted := rn.NodeSelector.match(key, value); !isRestricted {
+				continue // this rule does not restrict the key
+			}
+
+			podRule := slices.IndexFunc(rn.AllowedPods,
+				func(allowedPod podConfig) bool { return allowedPod.match(pod) })
 
-	for removeKey := range nodeSelector {
-		var accepted bool
-		if slices.Contains(acceptSelectors, removeKey) {
-			accepted = true
+			if podRule < 0 {
+				// pod is not allowed to have the key
+				delete(spec.NodeSelector, key)
+				removed = true
+				track = fmt.Sprintf("[nodeSelectorRule=%d/%d rule=%s]",
+					j, len(restrictNodeSelector), rn.id)
+				fired = addFired(fired, rn.id)
+				break
+			}
+
+			track = fmt.Sprintf("[nodeSelectorRule=%d/%d podRule=%d/%d]",
+				j, len(restrictNodeSelector), podRule, len(rn.AllowedPods))
+
+			if rn.Final {
+				// pod allowed by final rule, skip remaining rules
+				track += " [final]"
+				break
+			}
 		}
-		if !accepted {
-			key := escapeJSONPointer(removeKey)
-			toRemove = append(toRemove, fmt.Sprintf(`{"op":"remove","path":"/spec/nodeSelector/%s"}`, key))
+
+		log.Printf("pod: %s/%s: nodeSelector=%s=%s: removed=%t %s",
+			pod.namespace, pod.name, key, value, removed, track)
+	}
+
+	return fired
+}
+
+// acceptNodeSelectorsRule is the name of the default rule built from
+// ACCEPT_NODE_SELECTORS.
+const acceptNodeSelectorsRule = "accept_node_selectors"
+
+// acceptNodeSelectorsRules builds the default rule group that removes,
+// on CREATE, the nodeSelector keys not listed in acceptSelectors.
+// The group has the lowest priority, so it is evaluated after all other
+// rules, even those of negative priority, and a final
+// restrict_node_selectors rule allowing a pod exempts it.
+func acceptNodeSelectorsRules(acceptSelectors []string) (rulesConfig, error) {
+	key := "" // no accepted keys: remove every key
+	if len(acceptSelectors) > 0 {
+		quoted := make([]string, 0, len(acceptSelectors))
+		for _, s := range acceptSelectors {
+			quoted = append(quoted, regexp.QuoteMeta(s))
 		}
-		log.Printf("pod: %s/%s: nodeSelector=%s: accepted=%t",
-			namespace, podName, removeKey, accepted)
+		key = patternNegatePrefix + "^(" + strings.Join(quoted, "|") + ")$"
+	}
+
+	r := rulesConfig{
+		RestrictNodeSelectors: []restrictNodeSelectorConfig{
+			{
+				RuleName:     acceptNodeSelectorsRule,
+				Operations:   []string{operationCreate}, // pod nodeSelector is immutable
+				NodeSelector: nodeSelectorConfigPattern{Key: key},
+				Priority:     math.MinInt, // after user rules of any priority
+			},
+		},
 	}
 
-	return toRemove
+	return r, compileRules(r, "defaults")
 }
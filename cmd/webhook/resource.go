@@ -1,42 +1,51 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 
 	corev1 "k8s.io/api/core/v1"
 	api_resource "k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func addResource(namespace, podName, priorityClassName string, podLabels map[string]string,
-	podOwnerReferences []metav1.OwnerReference,
-	containers []corev1.Container, resources []setResource,
-	debug bool) []string {
+// addResource sets resource requests and limits of the containers
+// selected by container_types, changing them in place.
+// It returns the rules that changed resources.
+func addResource(pod podInfo, spec *corev1.PodSpec,
+	resources []setResource, debug bool) []string {
 
 	const me = "addResource"
 
-	var list []string
+	namespace := pod.namespace
+	podName := pod.name
+
+	var fired []string                        // rules that changed resources
+	finalized := map[*corev1.Container]bool{} // containers matched by final rule
 
 	//
 	// scan resource rules
 	//
 	for _, r := range resources {
-		if !r.Pod.match(namespace, podName, priorityClassName, podLabels,
-			podOwnerReferences) {
+		if !r.Pod.match(pod) {
 			continue
 		}
 		// found pod
-		for i, c := range containers {
-			if !r.container.matchString(c.Name) {
+		for _, c := range selectContainers(spec, r.ContainerTypes) {
+			if finalized[c.Container] {
+				continue // container already matched by final rule
+			}
+			if !r.container.matchString(c.Name) || !r.image.matchString(c.Image) {
 				continue
 			}
 			// found container
 
+			if r.Final {
+				finalized[c.Container] = true
+			}
+
 			if debug {
-				log.Printf("DEBUG %s: rule=%d/%d namespace=%s pod=%s container=%s resources=%v",
-					me, i+1, len(resources), namespace, podName, c.Name, r)
+				log.Printf("DEBUG %s: rule=%s namespace=%s pod=%s container=%v resources=%v",
+					me, r.id, namespace, podName, c, r)
 			}
 
 			origReqCPU := quantityValue(c.Resources.Requests.Cpu())
@@ -65,59 +74,78 @@ func addResource(namespace, podName, priorityClassName string, podLabels map[str
 			recordChange(&changes, limMemSource, limMem, origLimMem, "limits", "memory")
 			recordChange(&changes, limESSource, limES, origLimES, "limits", "ephemeral-storage")
 
-			log.Printf("%s: %s/%s/%d/%s: changes(%d): %q",
-				me, namespace, podName, i, c.Name, len(changes), changes)
+			log.Printf("%s: %s/%s/%v: changes(%d): %q",
+				me, namespace, podName, c, len(changes), changes)
 
 			if len(changes) == 0 {
 				continue // no change for this container
 			}
 
-			// append change patch for this container
-
-			requests := map[string]string{}
-			if reqCPU != "" {
-				requests["cpu"] = reqCPU
-			}
-			if reqMem != "" {
-				requests["memory"] = reqMem
-			}
-			if reqES != "" {
-				requests["ephemeral-storage"] = reqES
+			requests, errReq := resourceList(map[corev1.ResourceName]string{
+				corev1.ResourceCPU:              reqCPU,
+				corev1.ResourceMemory:           reqMem,
+				corev1.ResourceEphemeralStorage: reqES,
+			})
+			if errReq != nil {
+				log.Printf("ERROR: %s: %s/%s/%v: requests: %v",
+					me, namespace, podName, c, errReq)
+				continue
 			}
 
-			limits := map[string]string{}
-			if limCPU != "" {
-				limits["cpu"] = limCPU
-			}
-			if limMem != "" {
-				limits["memory"] = limMem
-			}
-			if limES != "" {
-				limits["ephemeral-storage"] = limES
+			limits, errLim := resourceList(map[corev1.ResourceName]string{
+				corev1.ResourceCPU:              limCPU,
+				corev1.ResourceMemory:           limMem,
+				corev1.ResourceEphemeralStorage: limES,
+			})
+			if errLim != nil {
+				log.Printf("ERROR: %s: %s/%s/%v: limits: %v",
+					me, namespace, podName, c, errLim)
+				continue
 			}
 
 			if debug {
-				log.Printf("DEBUG %s: %s/%s/%s(%d): setting: requests=%#v limits=%#v",
-					me, namespace, podName, c.Name, i, requests, limits)
+				log.Printf("DEBUG %s: %s/%s/%v: setting: requests=%v limits=%v",
+					me, namespace, podName, c, requests, limits)
 			}
 
-			req := generateResource(i, "requests", requests)
-			if req != "" {
-				list = append(list, req)
-			}
+			fired = addFired(fired, r.id)
 
-			lim := generateResource(i, "limits", limits)
-			if lim != "" {
-				list = append(list, lim)
-			}
+			setResourceList(&c.Resources.Requests, requests)
+			setResourceList(&c.Resources.Limits, limits)
 		}
 	}
 
-	if debug {
-		log.Printf("DEBUG %s: %v", me, list)
+	return fired
+}
+
+// resourceList parses the quantities, skipping empty values.
+func resourceList(values map[corev1.ResourceName]string) (corev1.ResourceList, error) {
+	list := corev1.ResourceList{}
+	for name, v := range values {
+		if v == "" {
+			continue
+		}
+		q, err := api_resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s='%s': %v", name, v, err)
+		}
+		list[name] = q
 	}
+	return list, nil
+}
 
-	return list
+// setResourceList sets the quantities, keeping other resources
+// (like extended resources) untouched.
+func setResourceList(dst *corev1.ResourceList, values corev1.ResourceList) {
+	if len(values) == 0 {
+		return
+	}
+	if *dst == nil {
+		*dst = corev1.ResourceList{}
+	}
+	for name, q := range values {
+		(*dst)[name] = q
+	}
 }
 
 func recordChange(changes *[]string, source, value, origValue, reqLim, name string) {
@@ -148,15 +176,3 @@ func derive(values ...string) (string, string) {
 	}
 	return "", ""
 }
-
-func generateResource(i int, reqLim string, value map[string]string) string {
-	data, errJSON := json.Marshal(value)
-	if errJSON != nil {
-		log.Printf("ERROR: generateResource: json: %v", errJSON)
-		return ""
-	}
-
-	const templ = `{"op":"replace","path":"/spec/containers/%d/resources/%s","value":%s}`
-
-	return fmt.Sprintf(templ, i, reqLim, string(data))
-}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
-	"strings"
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
@@ -403,125 +401,44 @@ func TestAddResource(t *testing.T) {
 
 			const debug = false
 
-			list := addResource(data.namespace, data.podName,
-				data.priorityClassName, data.podLabels,
-				data.ownerReferences,
-				containerList,
-				r.Resources, debug)
-
-			expectedSize := 0
-			for _, c := range data.containers {
-				if len(c.expectRequests) > 0 {
-					expectedSize++
-				}
-				if len(c.expectLimits) > 0 {
-					expectedSize++
-				}
+			pod := podInfo{
+				namespace:         data.namespace,
+				name:              data.podName,
+				priorityClassName: data.priorityClassName,
+				labels:            data.podLabels,
+				ownerReferences:   data.ownerReferences,
 			}
 
-			if len(list) != expectedSize {
-				t.Errorf("resource list size=%d expected=%d list:%v",
-					len(list), expectedSize, list)
-				return
-			}
+			spec := v1.PodSpec{Containers: containerList}
+			mutated := spec.DeepCopy()
+			addResource(pod, mutated, r.Resources, debug)
 
-			if expectedSize == 0 {
-				return
-			}
+			for i, c := range data.containers {
 
-			//
-			// parse patch json string list into op list
-			//
-			var ops []op
-			for i, patch := range list {
-				var operation op
-				errJSON := json.Unmarshal([]byte(patch), &operation)
-				if errJSON != nil {
-					t.Errorf("patch %d/%d json error: %v", i+1, len(list), errJSON)
-					return
-				}
-				ops = append(ops, operation)
-			}
+				containerName := fmt.Sprintf("%s(%d)", c.container.Name, i)
 
-			// scan test containers
+				got := mutated.Containers[i].Resources
 
-			//
-			// ops: list of patch ops
-			// data.containers: list of test containers
-			//
-
-			var countFoundOp int
-
-			for dataContainerID, c := range data.containers {
-
-				containerName := fmt.Sprintf("%s(%d)", c.container.Name, dataContainerID)
-
-				// search patch op for container
-
-				for i, operation := range ops {
-					if operation.Op != "replace" {
-						t.Errorf("container=%s unexpected operation: %d/%d: %s",
-							containerName, i+1, len(ops), operation.Op)
-						return
+				if len(c.expectRequests) == 0 && len(c.expectLimits) == 0 {
+					// no change expected
+					if toRsrc(got.Requests) != toRsrc(c.container.Resources.Requests) ||
+						toRsrc(got.Limits) != toRsrc(c.container.Resources.Limits) {
+						t.Errorf("container=%s unexpected change: requests=%v limits=%v",
+							containerName, got.Requests, got.Limits)
 					}
+					continue
+				}
 
-					// "/spec/containers/0/resources/requests"
-
-					fields := strings.SplitN(operation.Path, "/", 6)
-
-					reqLim := fields[5]
-					containerID := fields[3]
-					cID, errConv := strconv.Atoi(containerID)
-					if errConv != nil {
-						t.Errorf("container=%s parse container ID from path=%s error: %d/%d: %v",
-							containerName, operation.Path, i+1, len(ops), errConv)
-						return
-					}
-
-					if cID != dataContainerID {
-						continue // keep searching
-					}
-
-					if reqLim == "requests" {
-						//
-						// found request
-						//
-						if errCompare := compareResource(c.expectRequests, operation.Value); errCompare != nil {
-							t.Errorf("container=%s requests compare error: %d/%d: %v",
-								containerName, i+1, len(ops), errCompare)
-							return
-						}
-						countFoundOp++
-						continue // next op
-					}
-
-					if reqLim == "limits" {
-						//
-						// found limit
-						//
-						if errCompare := compareResource(c.expectLimits, operation.Value); errCompare != nil {
-							t.Errorf("container=%s limits compare error: %d/%d: %v",
-								containerName, i+1, len(ops), errCompare)
-							return
-						}
-						countFoundOp++
-						continue // next op
-					}
-
-					t.Errorf("container=%s unexpected operation path=%s: %d/%d: %#v",
-						containerName, operation.Path, i+1, len(ops), operation)
-					return
-
-				} // search patch op for container
-
-			} // scan test containers
+				if errCompare := compareResource(c.expectRequests, toRsrc(got.Requests)); errCompare != nil {
+					t.Errorf("container=%s requests compare error: %v",
+						containerName, errCompare)
+				}
 
-			if countFoundOp != expectedSize {
-				t.Errorf("operation count mismatch: expected=%d got=%d",
-					expectedSize, countFoundOp)
-				return
+				if errCompare := compareResource(c.expectLimits, toRsrc(got.Limits)); errCompare != nil {
+					t.Errorf("container=%s limits compare error: %v",
+						containerName, errCompare)
+				}
 			}
-
 		})
 
 	}
@@ -547,14 +464,22 @@ func compareResource(expected map[string]string, got rsrc) error {
 	return nil
 }
 
-type op struct {
-	Op    string `json:"op"`
-	Path  string `path:"path"`
-	Value rsrc   `path:"value"`
-}
-
 type rsrc struct {
 	CPU              string `json:"cpu"`
 	Memory           string `json:"memory"`
 	EphemeralStorage string `json:"ephemeral-storage"`
 }
+
+func toRsrc(list v1.ResourceList) rsrc {
+	var r rsrc
+	if q, found := list[v1.ResourceCPU]; found {
+		r.CPU = q.String()
+	}
+	if q, found := list[v1.ResourceMemory]; found {
+		r.Memory = q.String()
+	}
+	if q, found := list[v1.ResourceEphemeralStorage]; found {
+		r.EphemeralStorage = q.String()
+	}
+	return r
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
-	"os"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -13,42 +14,103 @@ import (
 
 type rulesList struct {
 	Rules []rulesConfig `yaml:"rules"`
+
+	hash    string      // identifies the active rules in the mutated-by annotation
+	ordered rulesConfig // all rule groups in evaluation order, see orderRules()
 }
 
 type rulesConfig struct {
-	RestrictTolerations []restrictTolerationConfig `yaml:"restrict_tolerations"`
-	PlacePods           []placementConfig          `yaml:"place_pods"`
-	Resources           []setResource              `yaml:"resources"`
-	DisableDaemonsets   []selectDaemonset          `yaml:"disable_daemonsets"`
-	NamespacesAddLabels []nsAddLabels              `yaml:"namespaces_add_labels"`
+	Strategy string `yaml:"strategy"` // first (default) or merge
+
+	RestrictTolerations   []restrictTolerationConfig   `yaml:"restrict_tolerations"`
+	RestrictNodeSelectors []restrictNodeSelectorConfig `yaml:"restrict_node_selectors"`
+	RestrictNodeAffinity  []restrictNodeAffinityConfig `yaml:"restrict_node_affinity"`
+	PlacePods             []placementConfig            `yaml:"place_pods"`
+	Resources             []setResource                `yaml:"resources"`
+	DisableDaemonsets     []selectDaemonset            `yaml:"disable_daemonsets"`
+	NamespacesAddLabels   []nsAddLabels                `yaml:"namespaces_add_labels"`
 }
 
 type nsAddLabels struct {
-	Name      string            `yaml:"name"`
-	AddLabels map[string]string `yaml:"add_labels"`
+	RuleName        string   `yaml:"rule_name"`
+	Mode            string   `yaml:"mode"`
+	Operations      []string `yaml:"operations"`
+	Priority        int      `yaml:"priority"`
+	Final           bool     `yaml:"final"`
+	namespaceConfig `yaml:",inline"`
+	AddLabels       map[string]string `yaml:"add_labels"`
+
+	id       string
+	group    int    // index of the rule group, see orderRules()
+	strategy string // strategy of the rule group
+}
+
+// namespaceConfig selects namespaces.
+// All fields must match, like in podConfig.
+type namespaceConfig struct {
+	Name string `yaml:"name"`
+	CEL  string `yaml:"cel"`
+
+	And []namespaceConfig `yaml:"and"`
+	Or  []namespaceConfig `yaml:"or"`
+	Not *namespaceConfig  `yaml:"not"`
 
 	name *pattern
+	cel  *celProgram
 }
 
 type selectDaemonset struct {
+	RuleName        string   `yaml:"rule_name"`
+	Mode            string   `yaml:"mode"`
+	Operations      []string `yaml:"operations"`
+	Priority        int      `yaml:"priority"`
+	Final           bool     `yaml:"final"`
+	daemonsetConfig `yaml:",inline"`
+
+	NodeSelector map[string]string `yaml:"node_selector"`
+
+	id       string
+	group    int    // index of the rule group, see orderRules()
+	strategy string // strategy of the rule group
+}
+
+// daemonsetConfig selects daemonsets.
+// All fields must match, like in podConfig.
+type daemonsetConfig struct {
 	Namespace string            `yaml:"namespace"`
 	Name      string            `yaml:"name"`
 	Labels    map[string]string `yaml:"labels"`
 
-	NodeSelector map[string]string `yaml:"node_selector"`
+	Annotations     map[string]string `yaml:"annotations"`
+	NamespaceLabels map[string]string `yaml:"namespace_labels"`
+	CEL             string            `yaml:"cel"`
+
+	And []daemonsetConfig `yaml:"and"`
+	Or  []daemonsetConfig `yaml:"or"`
+	Not *daemonsetConfig  `yaml:"not"`
 
 	namespace *pattern
 	name      *pattern
+	cel       *celProgram
 }
 
 type setResource struct {
+	RuleName         string    `yaml:"rule_name"`
+	Mode             string    `yaml:"mode"`
+	Operations       []string  `yaml:"operations"`
+	Priority         int       `yaml:"priority"`
+	Final            bool      `yaml:"final"`
 	Pod              podConfig `yaml:"pod"`
 	Container        string    `yaml:"container"`
+	Image            string    `yaml:"image"`
+	ContainerTypes   []string  `yaml:"container_types"` // default: containers
 	Memory           resource  `yaml:"memory"`
 	CPU              resource  `yaml:"cpu"`
 	EphemeralStorage resource  `yaml:"ephemeral-storage"`
 
+	id        string
 	container *pattern
+	image     *pattern
 }
 
 type resource struct {
@@ -57,8 +119,15 @@ type resource struct {
 }
 
 type restrictTolerationConfig struct {
+	RuleName    string                  `yaml:"rule_name"`
+	Mode        string                  `yaml:"mode"`
+	Operations  []string                `yaml:"operations"`
+	Priority    int                     `yaml:"priority"`
+	Final       bool                    `yaml:"final"`
 	Toleration  tolerationConfigPattern `yaml:"toleration"`
 	AllowedPods []podConfig             `yaml:"allowed_pods"`
+
+	id string
 }
 
 type tolerationConfigPattern struct {
@@ -70,18 +139,77 @@ type tolerationConfigPattern struct {
 	effect   *pattern
 }
 
+type restrictNodeSelectorConfig struct {
+	RuleName     string                    `yaml:"rule_name"`
+	Mode         string                    `yaml:"mode"`
+	Operations   []string                  `yaml:"operations"`
+	Priority     int                       `yaml:"priority"`
+	Final        bool                      `yaml:"final"`
+	NodeSelector nodeSelectorConfigPattern `yaml:"node_selector"`
+	AllowedPods  []podConfig               `yaml:"allowed_pods"`
+
+	id string
+}
+
+type nodeSelectorConfigPattern struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+
+	key   *pattern
+	value *pattern
+}
+
+type restrictNodeAffinityConfig struct {
+	RuleName    string                       `yaml:"rule_name"`
+	Mode        string                       `yaml:"mode"`
+	Operations  []string                     `yaml:"operations"`
+	Priority    int                          `yaml:"priority"`
+	Final       bool                         `yaml:"final"`
+	Expression  nodeAffinityExpressionConfig `yaml:"expression"`
+	AllowedPods []podConfig                  `yaml:"allowed_pods"`
+
+	id string
+}
+
+// nodeAffinityExpressionConfig matches node selector requirements
+// (matchExpressions and matchFields) in node affinity terms.
+type nodeAffinityExpressionConfig struct {
+	Key      string `yaml:"key"`
+	Operator string `yaml:"operator"`
+	Value    string `yaml:"value"` // matches if any value matches
+
+	key      *pattern
+	operator *pattern
+	value    *pattern
+}
+
 type podConfig struct {
 	Namespace            string            `yaml:"namespace"`
 	Name                 string            `yaml:"name"`
 	HasPriorityClassName string            `yaml:"has_priority_class_name"`
 	Labels               map[string]string `yaml:"labels"`
+	Annotations          map[string]string `yaml:"annotations"`
+	NamespaceLabels      map[string]string `yaml:"namespace_labels"`
 	HasOwnerReference    ownerReference    `yaml:"has_owner_reference"`
-
+	Images               imagesConfig      `yaml:"images"`
+	ServiceAccount       string            `yaml:"service_account"`
+	RequestedByUser      string            `yaml:"requested_by_user"`
+	RequestedByGroup     string            `yaml:"requested_by_group"`
+	CEL                  string            `yaml:"cel"`
+
+	// and requires all items to match, or requires any item to match,
+	// and not requires its item not to match. They nest freely.
 	And []podConfig `yaml:"and"`
+	Or  []podConfig `yaml:"or"`
+	Not *podConfig  `yaml:"not"`
 
 	namespace            *pattern
 	name                 *pattern
 	hasPriorityClassName *pattern
+	serviceAccount       *pattern
+	requestedByUser      *pattern
+	requestedByGroup     *pattern
+	cel                  *celProgram
 }
 
 type ownerReference struct {
@@ -94,19 +222,38 @@ type ownerReference struct {
 }
 
 type placementConfig struct {
-	Pods []podConfig `yaml:"pods"`
-	Add  addConfig   `yaml:"add"`
+	RuleName   string      `yaml:"rule_name"`
+	Mode       string      `yaml:"mode"`
+	Operations []string    `yaml:"operations"`
+	Priority   int         `yaml:"priority"`
+	Final      bool        `yaml:"final"`
+	Pods       []podConfig `yaml:"pods"`
+	Add        addConfig   `yaml:"add"`
+
+	id       string
+	group    int    // index of the rule group, see orderRules()
+	strategy string // strategy of the rule group
 }
 
 type addConfig struct {
-	Tolerations       []tolerationConfig         `yaml:"tolerations"`
-	NodeSelector      map[string]string          `yaml:"node_selector"`
-	PriorityClassName string                     `yaml:"priority_class_name"`
-	Containers        map[string]containerConfig `yaml:"containers"` // containerName -> config
+	Tolerations            []tolerationConfig         `yaml:"tolerations"`
+	NodeSelector           map[string]string          `yaml:"node_selector"`
+	NodeSelectorOnConflict string                     `yaml:"node_selector_on_conflict"` // overwrite (default) or skip
+	PriorityClassName      string                     `yaml:"priority_class_name"`
+	Containers             map[string]containerConfig `yaml:"containers"` // containerName -> config
+	Volumes                []map[string]any           `yaml:"volumes"`    // field name -> value
 }
 
 type containerConfig struct {
-	Env []map[string]any `yaml:"env"` // field name -> value
+	Env            []map[string]any `yaml:"env"`             // field name -> value
+	EnvFrom        []map[string]any `yaml:"env_from"`        // field name -> value
+	RemoveEnv      []string         `yaml:"remove_env"`      // env var name patterns
+	OnConflict     string           `yaml:"on_conflict"`     // default for env and env_from entries
+	VolumeMounts   []map[string]any `yaml:"volume_mounts"`   // field name -> value
+	ContainerTypes []string         `yaml:"container_types"` // default: containers
+
+	name      *pattern // nil for exact container name, see compileContainerName()
+	removeEnv []*pattern
 }
 
 type tolerationConfig struct {
@@ -116,12 +263,73 @@ type tolerationConfig struct {
 	Effect   string `yaml:"effect"`
 }
 
-func (s *selectDaemonset) match(namespace, dsName string, dsLabels map[string]string) bool {
-	return s.namespace.matchString(namespace) && s.name.matchString(dsName) && hasLabels(dsLabels, s.Labels)
+// daemonsetInfo holds the daemonset attributes used to match rules.
+type daemonsetInfo struct {
+	namespace       string
+	name            string
+	labels          map[string]string
+	annotations     map[string]string
+	namespaceLabels map[string]string
+	cel             *celInput
 }
 
-func (n *nsAddLabels) match(name string) bool {
-	return n.name.matchString(name)
+// namespaceInfo holds the namespace attributes used to match rules.
+type namespaceInfo struct {
+	name   string
+	labels map[string]string
+	cel    *celInput
+}
+
+// podInfo holds the pod attributes used to match rules.
+type podInfo struct {
+	namespace         string
+	name              string
+	priorityClassName string
+	labels            map[string]string
+	annotations       map[string]string
+	ownerReferences   []metav1.OwnerReference
+	namespaceLabels   map[string]string
+	containers        []corev1.Container
+	initContainers    []corev1.Container
+	serviceAccount    string
+	user              string   // user that sent the admission request
+	groups            []string // groups of the user that sent the admission request
+	cel               *celInput
+}
+
+// matchGroups evaluates the and, or, not combinators.
+// An empty or list matches anything, as does a nil not.
+func matchGroups[T any](and, or []T, not *T, match func(*T) bool) bool {
+	for i := range and {
+		if !match(&and[i]) {
+			return false
+		}
+	}
+	if len(or) > 0 && !slices.ContainsFunc(or, func(item T) bool { return match(&item) }) {
+		return false
+	}
+	if not != nil && match(not) {
+		return false
+	}
+	return true
+}
+
+func (s *daemonsetConfig) match(ds daemonsetInfo) bool {
+	return matchGroups(s.And, s.Or, s.Not,
+		func(sub *daemonsetConfig) bool { return sub.match(ds) }) &&
+		s.namespace.matchString(ds.namespace) &&
+		s.name.matchString(ds.name) &&
+		hasLabels(ds.labels, s.Labels) &&
+		hasLabels(ds.annotations, s.Annotations) &&
+		hasLabels(ds.namespaceLabels, s.NamespaceLabels) &&
+		s.cel.match(ds.cel)
+}
+
+func (n *namespaceConfig) match(ns namespaceInfo) bool {
+	return matchGroups(n.And, n.Or, n.Not,
+		func(sub *namespaceConfig) bool { return sub.match(ns) }) &&
+		n.name.matchString(ns.name) &&
+		n.cel.match(ns.cel)
 }
 
 func (t *tolerationConfigPattern) match(podToleration corev1.Toleration) bool {
@@ -131,36 +339,44 @@ func (t *tolerationConfigPattern) match(podToleration corev1.Toleration) bool {
 		t.effect.matchString(string(podToleration.Effect))
 }
 
-func (pc *placementConfig) match(namespace, podName, priorityClassName string,
-	podLabels map[string]string,
-	podOwnerReferences []metav1.OwnerReference) bool {
+func (n *nodeSelectorConfigPattern) match(key, value string) bool {
+	return n.key.matchString(key) && n.value.matchString(value)
+}
+
+func (e *nodeAffinityExpressionConfig) match(req corev1.NodeSelectorRequirement) bool {
+	return e.key.matchString(req.Key) &&
+		e.operator.matchString(string(req.Operator)) &&
+		e.value.matchAny(req.Values)
+}
+
+func (pc *placementConfig) match(pod podInfo) bool {
 	for _, podC := range pc.Pods {
-		if podC.match(namespace, podName, priorityClassName, podLabels,
-			podOwnerReferences) {
+		if podC.match(pod) {
 			return true
 		}
 	}
 	return false
 }
 
-func (p *podConfig) match(namespace, podName, priorityClassName string,
-	podLabels map[string]string,
-	podOwnerReferences []metav1.OwnerReference) bool {
+func (p *podConfig) match(pod podInfo) bool {
 
-	if len(p.And) > 0 {
-		for _, sub := range p.And {
-			if !sub.match(namespace, podName, priorityClassName, podLabels,
-				podOwnerReferences) {
-				return false
-			}
-		}
+	if !matchGroups(p.And, p.Or, p.Not,
+		func(sub *podConfig) bool { return sub.match(pod) }) {
+		return false
 	}
 
-	return p.namespace.matchString(namespace) &&
-		p.name.matchString(podName) &&
-		p.hasPriorityClassName.matchString(priorityClassName) &&
-		hasLabels(podLabels, p.Labels) &&
-		hasOwnerReference(podOwnerReferences, p.HasOwnerReference)
+	return p.namespace.matchString(pod.namespace) &&
+		p.name.matchString(pod.name) &&
+		p.hasPriorityClassName.matchString(pod.priorityClassName) &&
+		hasLabels(pod.labels, p.Labels) &&
+		hasLabels(pod.annotations, p.Annotations) &&
+		hasLabels(pod.namespaceLabels, p.NamespaceLabels) &&
+		hasOwnerReference(pod.ownerReferences, p.HasOwnerReference) &&
+		p.Images.match(pod.containers, pod.initContainers) &&
+		p.serviceAccount.matchString(pod.serviceAccount) &&
+		p.requestedByUser.matchString(pod.user) &&
+		p.requestedByGroup.matchAny(pod.groups) &&
+		p.cel.match(pod.cel)
 }
 
 func hasOwnerReference(existingRefs []metav1.OwnerReference, required ownerReference) bool {
@@ -227,123 +443,255 @@ func matchLabelValue(existing, required string) bool {
 	return pat.matchString(existing)
 }
 
-func loadRules(path string, requireKnownFields bool) (rulesList, error) {
-	data, errRead := os.ReadFile(path)
-	if errRead != nil {
-		return rulesList{}, errRead
+func yamlDecode(data []byte, v any, requireKnownFields bool) error {
+	if requireKnownFields {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		return decoder.Decode(v)
 	}
-	return newRules(data, requireKnownFields)
+	return yaml.Unmarshal(data, v)
 }
 
 func newRules(data []byte, requireKnownFields bool) (rulesList, error) {
 	var list rulesList
 
-	if requireKnownFields {
-		decoder := yaml.NewDecoder(bytes.NewReader(data))
-		decoder.KnownFields(true)
-		if errYaml := decoder.Decode(&list); errYaml != nil {
-			return list, errYaml
-		}
-	} else {
-		if errYaml := yaml.Unmarshal(data, &list); errYaml != nil {
-			return list, errYaml
+	if errYaml := yamlDecode(data, &list, requireKnownFields); errYaml != nil {
+		return list, errYaml
+	}
+
+	for i, r := range list.Rules {
+		if errCompile := compileRules(r, fmt.Sprintf("rules[%d]", i)); errCompile != nil {
+			return list, errCompile
 		}
 	}
 
-	for _, r := range list.Rules {
+	if errNames := checkRuleNames(list.Rules); errNames != nil {
+		return list, errNames
+	}
+
+	list.ordered = orderRules(list.Rules)
+
+	return list, nil
+}
+
+// newRulesConfig parses and compiles a single rules section,
+// that is, one item under the rules: list.
+// Unnamed rule items are identified by prefix and position.
+func newRulesConfig(data []byte, requireKnownFields bool, prefix string) (rulesConfig, error) {
+	var r rulesConfig
+
+	if errYaml := yamlDecode(data, &r, requireKnownFields); errYaml != nil {
+		return r, errYaml
+	}
+
+	if errCompile := compileRules(r, prefix); errCompile != nil {
+		return r, errCompile
+	}
+
+	return r, checkRuleNames([]rulesConfig{r})
+}
+
+// compileRules compiles patterns in place.
+func compileRules(r rulesConfig, prefix string) error {
+
+	if errMode := checkRulesMode(r); errMode != nil {
+		return errMode
+	}
+
+	if errOps := checkRulesOperations(r); errOps != nil {
+		return errOps
+	}
+
+	if errStrategy := checkStrategy(r.Strategy); errStrategy != nil {
+		return errStrategy
+	}
 
-		for i := range r.RestrictTolerations {
+	if errConflict := checkRulesOnConflict(r); errConflict != nil {
+		return errConflict
+	}
 
-			{
-				key, errKey := patternCompile(r.RestrictTolerations[i].Toleration.Key)
-				if errKey != nil {
-					return list, errKey
-				}
-				r.RestrictTolerations[i].Toleration.key = key
+	if errTypes := checkRulesContainerTypes(r); errTypes != nil {
+		return errTypes
+	}
+
+	for i := range r.RestrictTolerations {
+
+		{
+			key, errKey := patternCompile(r.RestrictTolerations[i].Toleration.Key)
+			if errKey != nil {
+				return errKey
 			}
+			r.RestrictTolerations[i].Toleration.key = key
+		}
 
-			{
-				op, errOp := patternCompile(r.RestrictTolerations[i].Toleration.Operator)
-				if errOp != nil {
-					return list, errOp
-				}
-				r.RestrictTolerations[i].Toleration.operator = op
+		{
+			op, errOp := patternCompile(r.RestrictTolerations[i].Toleration.Operator)
+			if errOp != nil {
+				return errOp
 			}
+			r.RestrictTolerations[i].Toleration.operator = op
+		}
 
-			{
-				v, errV := patternCompile(r.RestrictTolerations[i].Toleration.Value)
-				if errV != nil {
-					return list, errV
-				}
-				r.RestrictTolerations[i].Toleration.value = v
+		{
+			v, errV := patternCompile(r.RestrictTolerations[i].Toleration.Value)
+			if errV != nil {
+				return errV
 			}
+			r.RestrictTolerations[i].Toleration.value = v
+		}
 
-			{
-				eff, errEff := patternCompile(r.RestrictTolerations[i].Toleration.Effect)
-				if errEff != nil {
-					return list, errEff
-				}
-				r.RestrictTolerations[i].Toleration.effect = eff
+		{
+			eff, errEff := patternCompile(r.RestrictTolerations[i].Toleration.Effect)
+			if errEff != nil {
+				return errEff
 			}
+			r.RestrictTolerations[i].Toleration.effect = eff
+		}
 
-			for j := range r.RestrictTolerations[i].AllowedPods {
+		for j := range r.RestrictTolerations[i].AllowedPods {
 
-				p, errCompile := compilePod(r.RestrictTolerations[i].AllowedPods[j])
-				if errCompile != nil {
-					return list, errCompile
-				}
+			p, errCompile := compilePod(r.RestrictTolerations[i].AllowedPods[j])
+			if errCompile != nil {
+				return errCompile
+			}
 
-				r.RestrictTolerations[i].AllowedPods[j] = p
+			r.RestrictTolerations[i].AllowedPods[j] = p
+		}
+	}
+
+	for i := range r.RestrictNodeSelectors {
+
+		{
+			key, errKey := patternCompile(r.RestrictNodeSelectors[i].NodeSelector.Key)
+			if errKey != nil {
+				return errKey
 			}
+			r.RestrictNodeSelectors[i].NodeSelector.key = key
 		}
 
-		for i := range r.PlacePods {
+		{
+			v, errV := patternCompile(r.RestrictNodeSelectors[i].NodeSelector.Value)
+			if errV != nil {
+				return errV
+			}
+			r.RestrictNodeSelectors[i].NodeSelector.value = v
+		}
+
+		for j := range r.RestrictNodeSelectors[i].AllowedPods {
+
+			p, errCompile := compilePod(r.RestrictNodeSelectors[i].AllowedPods[j])
+			if errCompile != nil {
+				return errCompile
+			}
+
+			r.RestrictNodeSelectors[i].AllowedPods[j] = p
+		}
+	}
 
-			for j := range r.PlacePods[i].Pods {
+	for i := range r.RestrictNodeAffinity {
 
-				p, errCompile := compilePod(r.PlacePods[i].Pods[j])
-				if errCompile != nil {
-					return list, errCompile
-				}
+		{
+			key, errKey := patternCompile(r.RestrictNodeAffinity[i].Expression.Key)
+			if errKey != nil {
+				return errKey
+			}
+			r.RestrictNodeAffinity[i].Expression.key = key
+		}
 
-				r.PlacePods[i].Pods[j] = p
+		{
+			op, errOp := patternCompile(r.RestrictNodeAffinity[i].Expression.Operator)
+			if errOp != nil {
+				return errOp
 			}
+			r.RestrictNodeAffinity[i].Expression.operator = op
+		}
 
+		{
+			v, errV := patternCompile(r.RestrictNodeAffinity[i].Expression.Value)
+			if errV != nil {
+				return errV
+			}
+			r.RestrictNodeAffinity[i].Expression.value = v
 		}
 
-		for i := range r.Resources {
+		for j := range r.RestrictNodeAffinity[i].AllowedPods {
 
-			p, errCompile := compilePod(r.Resources[i].Pod)
+			p, errCompile := compilePod(r.RestrictNodeAffinity[i].AllowedPods[j])
 			if errCompile != nil {
-				return list, errCompile
+				return errCompile
 			}
-			r.Resources[i].Pod = p
 
-			c, errC := patternCompile(r.Resources[i].Container)
-			if errC != nil {
-				return list, errC
-			}
-			r.Resources[i].container = c
+			r.RestrictNodeAffinity[i].AllowedPods[j] = p
 		}
+	}
+
+	for i := range r.PlacePods {
 
-		for i := range r.DisableDaemonsets {
-			ds, errCompile := compileDaemonset(r.DisableDaemonsets[i])
+		for j := range r.PlacePods[i].Pods {
+
+			p, errCompile := compilePod(r.PlacePods[i].Pods[j])
 			if errCompile != nil {
-				return list, errCompile
+				return errCompile
 			}
-			r.DisableDaemonsets[i] = ds
+
+			r.PlacePods[i].Pods[j] = p
 		}
 
-		for i := range r.NamespacesAddLabels {
-			ns, errCompile := compileNamespace(r.NamespacesAddLabels[i])
+		for _, v := range r.PlacePods[i].Add.Volumes {
+			if _, errVol := volumeFromConfig(v); errVol != nil {
+				return errVol
+			}
+		}
+
+		for key, c := range r.PlacePods[i].Add.Containers {
+			c, errCompile := compileContainerConfig(key, c)
 			if errCompile != nil {
-				return list, errCompile
+				return errCompile
 			}
-			r.NamespacesAddLabels[i] = ns
+			r.PlacePods[i].Add.Containers[key] = c
 		}
+	}
+
+	for i := range r.Resources {
 
+		p, errCompile := compilePod(r.Resources[i].Pod)
+		if errCompile != nil {
+			return errCompile
+		}
+		r.Resources[i].Pod = p
+
+		c, errC := patternCompile(r.Resources[i].Container)
+		if errC != nil {
+			return errC
+		}
+		r.Resources[i].container = c
+
+		img, errImg := patternCompile(r.Resources[i].Image)
+		if errImg != nil {
+			return errImg
+		}
+		r.Resources[i].image = img
 	}
-	return list, nil
+
+	for i := range r.DisableDaemonsets {
+		ds, errCompile := compileDaemonset(r.DisableDaemonsets[i])
+		if errCompile != nil {
+			return errCompile
+		}
+		r.DisableDaemonsets[i] = ds
+	}
+
+	for i := range r.NamespacesAddLabels {
+		ns, errCompile := compileNamespace(r.NamespacesAddLabels[i])
+		if errCompile != nil {
+			return errCompile
+		}
+		r.NamespacesAddLabels[i] = ns
+	}
+
+	nameRules(r, prefix)
+
+	return nil
 }
 
 func compilePod(p podConfig) (podConfig, error) {
@@ -372,55 +720,98 @@ func compilePod(p podConfig) (podConfig, error) {
 		p.hasPriorityClassName = hasPriorityClassName
 	}
 
-	and, errAnd := compileAnd(p.And)
-	if errAnd != nil {
-		return p, errAnd
+	{
+		serviceAccount, err := patternCompile(p.ServiceAccount)
+		if err != nil {
+			return p, err
+		}
+		p.serviceAccount = serviceAccount
 	}
 
-	p.And = and
+	{
+		requestedByUser, err := patternCompile(p.RequestedByUser)
+		if err != nil {
+			return p, err
+		}
+		p.requestedByUser = requestedByUser
+	}
 
-	return p, nil
-}
+	{
+		requestedByGroup, err := patternCompile(p.RequestedByGroup)
+		if err != nil {
+			return p, err
+		}
+		p.requestedByGroup = requestedByGroup
+	}
 
-func compileAnd(list []podConfig) ([]podConfig, error) {
-	for i, p := range list {
+	{
+		c, err := compileCEL(p.CEL)
+		if err != nil {
+			return p, err
+		}
+		p.cel = c
+	}
 
-		{
-			ns, errNs := patternCompile(p.Namespace)
-			if errNs != nil {
-				return list, errNs
-			}
-			list[i].namespace = ns
+	{
+		images, err := compileImages(p.Images)
+		if err != nil {
+			return p, err
 		}
+		p.Images = images
+	}
 
-		{
-			name, errName := patternCompile(p.Name)
-			if errName != nil {
-				return list, errName
-			}
-			list[i].name = name
+	{
+		and, or, not, err := compileGroups(p.And, p.Or, p.Not, compilePod)
+		if err != nil {
+			return p, err
 		}
+		p.And, p.Or, p.Not = and, or, not
+	}
 
-		{
-			priorityClass, err := patternCompile(p.HasPriorityClassName)
-			if err != nil {
-				return list, err
-			}
-			list[i].hasPriorityClassName = priorityClass
+	return p, nil
+}
+
+// compileGroups compiles the items of the and, or, not combinators.
+func compileGroups[T any](and, or []T, not *T,
+	compile func(T) (T, error)) ([]T, []T, *T, error) {
+
+	for i, item := range and {
+		c, errCompile := compile(item)
+		if errCompile != nil {
+			return and, or, not, errCompile
 		}
+		and[i] = c
+	}
 
-		and, errAnd := compileAnd(p.And)
-		if errAnd != nil {
-			return list, errAnd
+	for i, item := range or {
+		c, errCompile := compile(item)
+		if errCompile != nil {
+			return and, or, not, errCompile
 		}
+		or[i] = c
+	}
 
-		list[i].And = and
+	if not != nil {
+		c, errCompile := compile(*not)
+		if errCompile != nil {
+			return and, or, not, errCompile
+		}
+		not = &c
 	}
 
-	return list, nil
+	return and, or, not, nil
 }
 
 func compileDaemonset(ds selectDaemonset) (selectDaemonset, error) {
+	c, err := compileDaemonsetConfig(ds.daemonsetConfig)
+	if err != nil {
+		return ds, err
+	}
+	ds.daemonsetConfig = c
+	return ds, nil
+}
+
+func compileDaemonsetConfig(ds daemonsetConfig) (daemonsetConfig, error) {
 
 	{
 		ns, errNs := patternCompile(ds.Namespace)
@@ -438,10 +829,36 @@ func compileDaemonset(ds selectDaemonset) (selectDaemonset, error) {
 		ds.name = name
 	}
 
+	{
+		c, err := compileCEL(ds.CEL)
+		if err != nil {
+			return ds, err
+		}
+		ds.cel = c
+	}
+
+	{
+		and, or, not, err := compileGroups(ds.And, ds.Or, ds.Not,
+			compileDaemonsetConfig)
+		if err != nil {
+			return ds, err
+		}
+		ds.And, ds.Or, ds.Not = and, or, not
+	}
+
 	return ds, nil
 }
 
 func compileNamespace(ns nsAddLabels) (nsAddLabels, error) {
+	c, err := compileNamespaceConfig(ns.namespaceConfig)
+	if err != nil {
+		return ns, err
+	}
+	ns.namespaceConfig = c
+	return ns, nil
+}
+
+func compileNamespaceConfig(ns namespaceConfig) (namespaceConfig, error) {
 
 	{
 		name, errNs := patternCompile(ns.Name)
@@ -451,5 +868,22 @@ func compileNamespace(ns nsAddLabels) (nsAddLabels, error) {
 		ns.name = name
 	}
 
+	{
+		c, err := compileCEL(ns.CEL)
+		if err != nil {
+			return ns, err
+		}
+		ns.cel = c
+	}
+
+	{
+		and, or, not, err := compileGroups(ns.And, ns.Or, ns.Not,
+			compileNamespaceConfig)
+		if err != nil {
+			return ns, err
+		}
+		ns.And, ns.Or, ns.Not = and, or, not
+	}
+
 	return ns, nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesStore holds the active rules. Handlers take a snapshot with get()
+// and keep using it for the whole request, while reload() atomically
+// swaps in a new rulesList.
+// The zero value holds no rules until the first reload().
+//
+// The active rules are the rules file followed by the rules from
+// MutationRule custom resources, if enabled, then the built-in defaults.
+type rulesStore struct {
+	active atomic.Pointer[rulesList]
+
+	mutex      sync.Mutex
+	file       rulesList         // rules from file
+	checksum   [sha256.Size]byte // checksum of last file content attempted
+	lastError  error             // error from last reload attempt, if any
+	lastReload time.Time         // time of last successful load
+
+	crdEnabled bool
+	crd        []rulesConfig // rules from custom resources, in merge order
+	crdFailed  []string      // custom resources rejected by last sync
+
+	defaults []rulesConfig // built-in rules, see acceptNodeSelectorsRules()
+
+	changed []chan struct{} // signaled on publish, see subscribe()
+}
+
+// get returns a consistent snapshot of the active rules.
+func (s *rulesStore) get() *rulesList {
+	return s.active.Load()
+}
+
+// reload reparses the rules file if its content changed.
+// On error the previous rules are kept active.
+func (s *rulesStore) reload(path string, requireKnownFields bool) (bool, error) {
+	data, errRead := os.ReadFile(path)
+	if errRead != nil {
+		s.setReadError(errRead)
+		return false, errRead
+	}
+
+	sum := sha256.Sum256(data)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sum == s.checksum {
+		return false, nil // unchanged
+	}
+	s.checksum = sum
+
+	r, errRules := newRules(data, requireKnownFields)
+	if errRules != nil {
+		s.lastError = errRules
+		return false, errRules
+	}
+
+	s.file = r
+	s.lastError = nil
+	s.lastReload = time.Now()
+	s.publish()
+
+	return true, nil
+}
+
+// setCRDRules replaces the rules from custom resources.
+func (s *rulesStore) setCRDRules(crd []rulesConfig, failed []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.crdEnabled = true
+	s.crd = crd
+	s.crdFailed = failed
+	s.publish()
+}
+
+// publish swaps in the merged rules. Caller must hold the mutex.
+func (s *rulesStore) publish() {
+	merged := rulesList{
+		Rules: make([]rulesConfig, 0, len(s.file.Rules)+len(s.crd)+len(s.defaults)),
+	}
+	merged.Rules = append(merged.Rules, s.file.Rules...)
+	merged.Rules = append(merged.Rules, s.crd...)
+	merged.Rules = append(merged.Rules, s.defaults...)
+	merged.hash = rulesHash(merged)
+	merged.ordered = orderRules(merged.Rules)
+	s.active.Store(&merged)
+
+	for _, c := range s.changed {
+		select {
+		case c <- struct{}{}:
+		default: // notification already pending
+		}
+	}
+}
+
+// subscribe returns a new channel signaled whenever new rules are published.
+func (s *rulesStore) subscribe() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := make(chan struct{}, 1)
+	s.changed = append(s.changed, c)
+	return c
+}
+
+// setReadError records the read error, and forgets the checksum so that
+// the next successful read is parsed again and clears the error, even if
+// the content is unchanged.
+func (s *rulesStore) setReadError(err error) {
+	s.mutex.Lock()
+	s.lastError = err
+	s.checksum = [sha256.Size]byte{}
+	s.mutex.Unlock()
+}
+
+// status reports the rules state for the health endpoint.
+func (s *rulesStore) status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var st string
+	if s.lastError != nil {
+		st = fmt.Sprintf("rules: reload error (keeping rules loaded at %s): %v",
+			s.lastReload.Format(time.RFC3339), s.lastError)
+	} else {
+		st = fmt.Sprintf("rules: ok (loaded at %s)",
+			s.lastReload.Format(time.RFC3339))
+	}
+
+	if s.crdEnabled {
+		st += fmt.Sprintf("\nrules crd: active=%d rejected=%d %v",
+			len(s.crd), len(s.crdFailed), s.crdFailed)
+	}
+
+	return st
+}
+
+// rulesAutoreload periodically checks the rules file for changes.
+func rulesAutoreload(store *rulesStore, path string, requireKnownFields bool,
+	interval time.Duration) {
+
+	const me = "rulesAutoreload"
+
+	for {
+		time.Sleep(interval)
+
+		changed, err := store.reload(path, requireKnownFields)
+		if err != nil {
+			log.Printf("%s: ERROR: rules=%s: keeping previous rules: %v",
+				me, path, err)
+			continue
+		}
+
+		if changed {
+			log.Printf("%s: rules=%s: reloaded", me, path)
+			logRules(store.get())
+		}
+	}
+}
+
+func logRules(r *rulesList) {
+	out, errY := yaml.Marshal(r)
+	if errY != nil {
+		log.Printf("ERROR: rules yaml: %v", errY)
+		return
+	}
+	log.Printf("rules loaded:\n%s", string(out))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reloadRules1 = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        node: alpha
+`
+
+const reloadRules2 = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        node: beta
+`
+
+const reloadRulesBad = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: "("
+`
+
+// go test -count 1 -run '^TestRulesReload$' ./cmd/webhook
+func TestRulesReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatalf("write rules: %v", err)
+		}
+	}
+
+	node := func(s *rulesStore) string {
+		return s.get().Rules[0].PlacePods[0].Add.NodeSelector["node"]
+	}
+
+	const requireKnownFields = false
+
+	store := &rulesStore{}
+
+	write(reloadRules1)
+	if changed, err := store.reload(path, requireKnownFields); err != nil || !changed {
+		t.Fatalf("initial load: changed=%t error=%v", changed, err)
+	}
+	if n := node(store); n != "alpha" {
+		t.Errorf("initial load: got=%s expected=alpha", n)
+	}
+
+	// unchanged file
+	if changed, err := store.reload(path, requireKnownFields); err != nil || changed {
+		t.Errorf("unchanged reload: changed=%t error=%v", changed, err)
+	}
+
+	snapshot := store.get()
+
+	// good edit
+	write(reloadRules2)
+	if changed, err := store.reload(path, requireKnownFields); err != nil || !changed {
+		t.Fatalf("good edit: changed=%t error=%v", changed, err)
+	}
+	if n := node(store); n != "beta" {
+		t.Errorf("good edit: got=%s expected=beta", n)
+	}
+	if n := snapshot.Rules[0].PlacePods[0].Add.NodeSelector["node"]; n != "alpha" {
+		t.Errorf("previous snapshot modified: got=%s expected=alpha", n)
+	}
+
+	// bad edit keeps previous rules
+	write(reloadRulesBad)
+	if changed, err := store.reload(path, requireKnownFields); err == nil || changed {
+		t.Errorf("bad edit: changed=%t error=%v", changed, err)
+	}
+	if n := node(store); n != "beta" {
+		t.Errorf("bad edit: got=%s expected=beta", n)
+	}
+	if st := store.status(); !strings.Contains(st, "reload error") {
+		t.Errorf("bad edit: missing error in status: %s", st)
+	}
+
+	// fixing the file clears the error
+	write(reloadRules1)
+	if changed, err := store.reload(path, requireKnownFields); err != nil || !changed {
+		t.Fatalf("fixed edit: changed=%t error=%v", changed, err)
+	}
+	if st := store.status(); strings.Contains(st, "error") {
+		t.Errorf("fixed edit: unexpected error in status: %s", st)
+	}
+}
+
+// go test -count 1 -run '^TestRulesReloadReadError$' ./cmd/webhook
+func TestRulesReloadReadError(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatalf("write rules: %v", err)
+		}
+	}
+
+	const requireKnownFields = false
+
+	store := &rulesStore{}
+
+	write(reloadRules1)
+	if changed, err := store.reload(path, requireKnownFields); err != nil || !changed {
+		t.Fatalf("initial load: changed=%t error=%v", changed, err)
+	}
+
+	// missing file keeps previous rules
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove rules: %v", err)
+	}
+	if changed, err := store.reload(path, requireKnownFields); err == nil || changed {
+		t.Errorf("missing file: changed=%t error=%v", changed, err)
+	}
+	if st := store.status(); !strings.Contains(st, "reload error") {
+		t.Errorf("missing file: missing error in status: %s", st)
+	}
+
+	// restoring the same content clears the error
+	write(reloadRules1)
+	if _, err := store.reload(path, requireKnownFields); err != nil {
+		t.Fatalf("restored file: error=%v", err)
+	}
+	if st := store.status(); strings.Contains(st, "error") {
+		t.Errorf("restored file: unexpected error in status: %s", st)
+	}
+	if n := store.get().Rules[0].PlacePods[0].Add.NodeSelector["node"]; n != "alpha" {
+		t.Errorf("restored file: got=%s expected=alpha", n)
+	}
+}
@@ -111,3 +111,112 @@ rules:
 		t.Fatal("expected error with strict mode enabled, got nil")
 	}
 }
+
+const rulesCombinators = `
+rules:
+- place_pods:
+  - pods:
+      # any namespace except kube-system, unless labeled critical
+      - or:
+          - not:
+              namespace: ^kube-system$
+          - namespace_labels:
+              critical: "true"
+    add:
+      node_selector:
+        node: alpha
+  disable_daemonsets:
+  - and:
+      - namespace: ^kube-system$
+      - not:
+          or:
+            - name: ^kube-proxy$
+            - labels:
+                critical: "true"
+    node_selector:
+      non-existing: "true"
+  namespaces_add_labels:
+  - or:
+      - name: ^team-
+      - name: ^app-
+    not:
+      name: -sandbox$
+    add_labels:
+      istio-injection: enabled
+`
+
+// go test -count 1 -run '^TestRulesCombinators$' ./cmd/webhook
+func TestRulesCombinators(t *testing.T) {
+	list, errRules := newRules([]byte(rulesCombinators), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+	r := list.Rules[0]
+
+	pods := []struct {
+		namespace string
+		labels    map[string]string // namespace labels
+		expected  bool
+	}{
+		{"default", nil, true},
+		{"kube-system", nil, false},
+		{"kube-system", map[string]string{"critical": "true"}, true},
+		{"kube-system", map[string]string{"critical": "false"}, false},
+	}
+	for i, data := range pods {
+		pod := podInfo{namespace: data.namespace, name: "pod-1", namespaceLabels: data.labels}
+		if got := r.PlacePods[0].match(pod); got != data.expected {
+			t.Errorf("pod %d: %s %v: got=%t expected=%t",
+				i, data.namespace, data.labels, got, data.expected)
+		}
+	}
+
+	daemonsets := []struct {
+		namespace string
+		name      string
+		labels    map[string]string
+		expected  bool
+	}{
+		{"default", "ds1", nil, false},
+		{"kube-system", "ds1", nil, true},
+		{"kube-system", "kube-proxy", nil, false},
+		{"kube-system", "ds1", map[string]string{"critical": "true"}, false},
+	}
+	for i, data := range daemonsets {
+		ds := daemonsetInfo{namespace: data.namespace, name: data.name, labels: data.labels}
+		if got := r.DisableDaemonsets[0].match(ds); got != data.expected {
+			t.Errorf("daemonset %d: %s/%s %v: got=%t expected=%t",
+				i, data.namespace, data.name, data.labels, got, data.expected)
+		}
+	}
+
+	namespaces := []struct {
+		name     string
+		expected bool
+	}{
+		{"team-a", true},
+		{"app-b", true},
+		{"team-a-sandbox", false},
+		{"default", false},
+	}
+	for i, data := range namespaces {
+		if got := r.NamespacesAddLabels[0].match(namespaceInfo{name: data.name}); got != data.expected {
+			t.Errorf("namespace %d: %s: got=%t expected=%t",
+				i, data.name, got, data.expected)
+		}
+	}
+}
+
+// go test -count 1 -run '^TestRulesCombinatorsBadPattern$' ./cmd/webhook
+func TestRulesCombinatorsBadPattern(t *testing.T) {
+	const input = `
+rules:
+- disable_daemonsets:
+  - or:
+      - not:
+          name: "("
+`
+	if _, err := newRules([]byte(input), true); err == nil {
+		t.Errorf("expected error for bad pattern nested in or/not, got nil")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// Rule group strategies.
+// With first, the first matching rule item applies.
+// With merge, every matching rule item applies, in order.
+const (
+	strategyFirst = "first"
+	strategyMerge = "merge"
+)
+
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case "", strategyFirst, strategyMerge:
+		return nil
+	}
+	return fmt.Errorf("bad rule strategy: '%s' (expecting %s or %s)",
+		strategy, strategyFirst, strategyMerge)
+}
+
+// ruleOrder holds the attributes that drive the evaluation of rule items
+// in rule groups, see orderRules() and selectRules().
+type ruleOrder struct {
+	id       string
+	group    int
+	strategy string
+	priority int
+	final    bool
+}
+
+// orderedRule is a rule item that can be applied along with the
+// rule items of other rule groups.
+type orderedRule interface {
+	order() ruleOrder
+}
+
+func (pc placementConfig) order() ruleOrder {
+	return ruleOrder{id: pc.id, group: pc.group, strategy: pc.strategy,
+		priority: pc.Priority, final: pc.Final}
+}
+
+func (ds selectDaemonset) order() ruleOrder {
+	return ruleOrder{id: ds.id, group: ds.group, strategy: ds.strategy,
+		priority: ds.Priority, final: ds.Final}
+}
+
+func (ns nsAddLabels) order() ruleOrder {
+	return ruleOrder{id: ns.id, group: ns.group, strategy: ns.strategy,
+		priority: ns.Priority, final: ns.Final}
+}
+
+// selectRules returns the matching items that apply, and their ids.
+//
+// items must be in evaluation order, see orderRules().
+// A rule group with strategy merge applies all its matching items,
+// otherwise only its first matching item applies.
+// A matching item with final stops the evaluation.
+func selectRules[T orderedRule](me string, items []T,
+	match func(T) bool) ([]T, []string) {
+
+	var matched []T
+	var ids []string
+	applied := map[int]bool{} // rule groups with a matching item
+
+	for _, item := range items {
+		o := item.order()
+		if o.strategy != strategyMerge && applied[o.group] {
+			continue // strategy first: rule group already applied
+		}
+		if !match(item) {
+			continue
+		}
+		matched = append(matched, item)
+		ids = append(ids, o.id)
+		applied[o.group] = true
+		if o.final {
+			log.Printf("%s: rule=%s: final: skipping remaining rules",
+				me, o.id)
+			break
+		}
+	}
+
+	if len(matched) > 1 {
+		log.Printf("%s: merging rules: %v", me, ids)
+	}
+
+	return matched, ids
+}
+
+// mergeOrder sorts items for merging: lower priority first,
+// so that higher priority overrides, then order of appearance.
+func mergeOrder[T orderedRule](items []T) []T {
+	items = slices.Clone(items)
+	sortByPriority(items, func(i T) int { return -i.order().priority })
+	return items
+}
+
+// mergeLabels merges maps key by key, in the given order, so later wins.
+func mergeLabels(me, kind string, ids []string, labels []map[string]string) map[string]string {
+	merged := map[string]string{}
+	for i, m := range labels {
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			v := m[k]
+			if old, found := merged[k]; found && old != v {
+				log.Printf("%s: merge: rule=%s: %s %s: '%s' replaced by '%s'",
+					me, ids[i], kind, k, old, v)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// mergePlacements combines the add sections of the matching placements:
+// node selectors are merged key by key, tolerations are de-duplicated,
+// container env vars are appended, and on conflicts (like volumes with the
+// same name) the placement with higher priority wins, then the later one.
+func mergePlacements(me string, matched []placementConfig) addConfig {
+	var merged addConfig
+
+	matched = mergeOrder(matched)
+
+	var ids []string
+	var nodeSelectors []map[string]string
+	for _, pc := range matched {
+		if len(pc.Add.NodeSelector) > 0 {
+			ids = append(ids, pc.id)
+			nodeSelectors = append(nodeSelectors, pc.Add.NodeSelector)
+		}
+		if pc.Add.NodeSelectorOnConflict != "" {
+			merged.NodeSelectorOnConflict = pc.Add.NodeSelectorOnConflict
+		}
+	}
+	if len(nodeSelectors) > 0 {
+		merged.NodeSelector = mergeLabels(me, "nodeSelector", ids, nodeSelectors)
+	}
+
+	for _, pc := range matched {
+		add := pc.Add
+
+		for _, tol := range add.Tolerations {
+			if slices.Contains(merged.Tolerations, tol) {
+				log.Printf("%s: merge: rule=%s: duplicate toleration skipped: %s",
+					me, pc.id, tolerationFieldsToString(tol.Key, tol.Operator,
+						tol.Value, tol.Effect))
+				continue
+			}
+			merged.Tolerations = append(merged.Tolerations, tol)
+		}
+
+		if add.PriorityClassName != "" {
+			if merged.PriorityClassName != "" &&
+				merged.PriorityClassName != add.PriorityClassName {
+				log.Printf("%s: merge: rule=%s: priorityClassName '%s' replaced by '%s'",
+					me, pc.id, merged.PriorityClassName, add.PriorityClassName)
+			}
+			merged.PriorityClassName = add.PriorityClassName
+		}
+
+		for _, vol := range add.Volumes {
+			j := slices.IndexFunc(merged.Volumes,
+				func(v map[string]any) bool { return v["name"] == vol["name"] })
+			if j < 0 {
+				merged.Volumes = append(merged.Volumes, vol)
+				continue
+			}
+			if !reflect.DeepEqual(merged.Volumes[j], vol) {
+				log.Printf("%s: merge: rule=%s: volume %v: '%v' replaced by '%v'",
+					me, pc.id, vol["name"], merged.Volumes[j], vol)
+			}
+			merged.Volumes[j] = vol
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(add.Containers)) {
+			if merged.Containers == nil {
+				merged.Containers = map[string]containerConfig{}
+			}
+			c, found := merged.Containers[name]
+			addContainer := add.Containers[name]
+			c.Env = slices.Concat(c.Env, addContainer.Env)
+			c.EnvFrom = slices.Concat(c.EnvFrom, addContainer.EnvFrom)
+			c.RemoveEnv = slices.Concat(c.RemoveEnv, addContainer.RemoveEnv)
+			c.removeEnv = slices.Concat(c.removeEnv, addContainer.removeEnv)
+			c.VolumeMounts = slices.Concat(c.VolumeMounts, addContainer.VolumeMounts)
+			c.name = addContainer.name // same key, same pattern
+			if !found {
+				c.ContainerTypes = addContainer.ContainerTypes
+			} else {
+				// the container is looked up among all types
+				types := slices.Concat(itemContainerTypes(c.ContainerTypes),
+					itemContainerTypes(addContainer.ContainerTypes))
+				slices.Sort(types)
+				c.ContainerTypes = slices.Compact(types)
+			}
+			merged.Containers[name] = c
+		}
+	}
+
+	return merged
+}
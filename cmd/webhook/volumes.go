@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addVolumes adds the volumes to the pod spec. A volume the pod already
+// has with the same name is skipped: silently when it is the same volume,
+// see sameOrDefaulted(), otherwise the name collision is logged and
+// reported in skipped, so that volume mounts do not use the pod volume
+// by mistake. A name repeated in volumes keeps the first volume, whose
+// mounts still apply.
+// It reports whether a volume was added.
+func addVolumes(namespace, podName string, spec *corev1.PodSpec,
+	volumes []map[string]any) (bool, map[string]bool) {
+
+	var changed bool
+	skipped := map[string]bool{}
+	podVolumes := len(spec.Volumes) // volumes the pod had before this add
+
+	for _, entry := range volumes {
+		volume, errVol := volumeFromConfig(entry)
+		if errVol != nil {
+			log.Printf("ERROR: addVolumes: ns=%s pod=%s bad volume: error=%v value=%v",
+				namespace, podName, errVol, entry)
+			continue
+		}
+
+		j := slices.IndexFunc(spec.Volumes,
+			func(v corev1.Volume) bool { return v.Name == volume.Name })
+
+		switch {
+		case j < 0:
+			log.Printf("addVolumes: ns=%s pod=%s adding volume name=%s entry=%v",
+				namespace, podName, volume.Name, entry)
+			spec.Volumes = append(spec.Volumes, volume)
+			changed = true
+		case sameOrDefaulted(volume, spec.Volumes[j]):
+			// already added
+		case j >= podVolumes:
+			log.Printf("addVolumes: ns=%s pod=%s skipping volume name=%s: duplicate name in rules, keeping the first",
+				namespace, podName, volume.Name)
+		default:
+			log.Printf("addVolumes: ns=%s pod=%s skipping volume name=%s: name collision with existing volume",
+				namespace, podName, volume.Name)
+			skipped[volume.Name] = true
+		}
+	}
+
+	return changed, skipped
+}
+
+// addVolumeMounts adds the volume mounts to the container. A mount is
+// skipped when the pod has no such volume, when the volume was skipped
+// by addVolumes(), or when the container already has another mount at
+// the same mountPath.
+// It reports whether a mount was added.
+func addVolumeMounts(namespace, podName string, spec *corev1.PodSpec,
+	container podContainer, mounts []map[string]any,
+	skippedVolumes map[string]bool) bool {
+
+	var changed bool
+
+	for _, entry := range mounts {
+		mount, errMount := volumeMountFromConfig(entry)
+		if errMount != nil {
+			log.Printf("ERROR: addVolumeMounts: ns=%s pod=%s container=%v bad volume mount: error=%v value=%v",
+				namespace, podName, container, errMount, entry)
+			continue
+		}
+
+		if skippedVolumes[mount.Name] {
+			log.Printf("addVolumeMounts: %s/%s/%v skipping volume mount name=%s: volume was skipped",
+				namespace, podName, container, mount.Name)
+			continue
+		}
+
+		if !slices.ContainsFunc(spec.Volumes,
+			func(v corev1.Volume) bool { return v.Name == mount.Name }) {
+			log.Printf("ERROR: addVolumeMounts: ns=%s pod=%s container=%v skipping volume mount name=%s: volume not found",
+				namespace, podName, container, mount.Name)
+			continue
+		}
+
+		j := slices.IndexFunc(container.VolumeMounts,
+			func(m corev1.VolumeMount) bool { return m.MountPath == mount.MountPath })
+
+		switch {
+		case j < 0:
+			log.Printf("addVolumeMounts: %s/%s/%v adding volume mount name=%s mountPath=%s",
+				namespace, podName, container, mount.Name, mount.MountPath)
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+			changed = true
+		case sameOrDefaulted(mount, container.VolumeMounts[j]):
+			// already mounted
+		default:
+			log.Printf("addVolumeMounts: %s/%s/%v skipping volume mount name=%s: mountPath collision: %s",
+				namespace, podName, container, mount.Name, mount.MountPath)
+		}
+	}
+
+	return changed
+}
+
+// sameOrDefaulted reports whether existing is the added object, possibly
+// with more fields set by API server defaults (like configMap defaultMode),
+// as found when the webhook is invoked again for the same pod.
+func sameOrDefaulted(added, existing any) bool {
+	a, errA := normalizeJSON(added)
+	if errA != nil {
+		return false
+	}
+	e, errE := normalizeJSON(existing)
+	if errE != nil {
+		return false
+	}
+	return jsonSubset(a, e)
+}
+
+// jsonSubset reports whether every field of a is found in b with
+// the same value, in the generic form of decoded JSON.
+func jsonSubset(a, b any) bool {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, isMap := b.(map[string]any)
+		if !isMap {
+			return false
+		}
+		for k, v := range av {
+			if w, found := bv[k]; !found || !jsonSubset(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		bv, isArray := b.([]any)
+		if !isArray || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonSubset(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// volumeFromConfig converts a volume entry from the rules into a volume.
+func volumeFromConfig(entry map[string]any) (corev1.Volume, error) {
+	var volume corev1.Volume
+	if err := fromConfig(entry, &volume); err != nil {
+		return volume, fmt.Errorf("volume: %v", err)
+	}
+	if volume.Name == "" {
+		return volume, fmt.Errorf("volume: missing name")
+	}
+	return volume, nil
+}
+
+// volumeMountFromConfig converts a volume_mounts entry from the rules
+// into a volume mount.
+func volumeMountFromConfig(entry map[string]any) (corev1.VolumeMount, error) {
+	var mount corev1.VolumeMount
+	if err := fromConfig(entry, &mount); err != nil {
+		return mount, fmt.Errorf("volume_mounts: %v", err)
+	}
+	if mount.Name == "" || mount.MountPath == "" {
+		return mount, fmt.Errorf("volume_mounts: requires name and mountPath")
+	}
+	return mount, nil
+}
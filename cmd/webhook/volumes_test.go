@@ -0,0 +1,325 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var volumesTestTable = []podRuleTestCase{
+	{
+		name: "volume mounted into all containers",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: corp-ca-bundle
+      containers:
+        "*":
+          volume_mounts:
+          - name: certs
+            mountPath: /etc/ssl/corp
+            readOnly: true
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"mountPath":"/etc/ssl/corp","name":"certs","readOnly":true}} {"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/etc/ssl/corp","name":"certs","readOnly":true}]} {"op":"add","path":"/spec/volumes/-","value":{"configMap":{"name":"corp-ca-bundle"},"name":"certs"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "projected service account token and tmpfs",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: vault-token
+        projected:
+          sources:
+          - serviceAccountToken:
+              audience: vault
+              path: token
+      - name: tmp
+        emptyDir:
+          medium: Memory
+      containers:
+        worker:
+          volume_mounts:
+          - name: vault-token
+            mountPath: /var/run/secrets/vault
+          - name: tmp
+            mountPath: /tmp
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/var/run/secrets/vault","name":"vault-token"},{"mountPath":"/tmp","name":"tmp"}]} {"op":"add","path":"/spec/volumes/-","value":{"name":"vault-token","projected":{"sources":[{"serviceAccountToken":{"audience":"vault","path":"token"}}]}}} {"op":"add","path":"/spec/volumes/-","value":{"emptyDir":{"medium":"Memory"},"name":"tmp"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "volume already added with defaults",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: ca-bundle
+        configMap:
+          name: corp-ca-bundle
+      containers:
+        app:
+          volume_mounts:
+          - name: ca-bundle
+            mountPath: /etc/ssl/corp
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"mountPath":"/etc/ssl/corp","name":"ca-bundle"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "volume name collision skips volume and mounts",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: data
+        emptyDir:
+          medium: Memory
+      containers:
+        worker:
+          volume_mounts:
+          - name: data
+            mountPath: /data
+`,
+		expected:    `[]`,
+		expectFired: `[]`,
+	},
+	{
+		name: "mountPath collision skips mount",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: corp-ca-bundle
+      containers:
+        app:
+          volume_mounts:
+          - name: certs
+            mountPath: /data
+`,
+		expected:    `[{"op":"add","path":"/spec/volumes/-","value":{"configMap":{"name":"corp-ca-bundle"},"name":"certs"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+	{
+		name: "mount of missing volume is skipped",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+          volume_mounts:
+          - name: missing
+            mountPath: /missing
+`,
+		expected:    `[]`,
+		expectFired: `[]`,
+	},
+	{
+		name: "merged placements add the same volume once",
+		rules: `
+rules:
+- strategy: merge
+  place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: tmp
+        emptyDir: {}
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: tmp
+        emptyDir: {}
+      containers:
+        worker:
+          volume_mounts:
+          - name: tmp
+            mountPath: /tmp
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/tmp","name":"tmp"}]} {"op":"add","path":"/spec/volumes/-","value":{"emptyDir":{},"name":"tmp"}}]`,
+		expectFired: `[rules[0].place_pods[0] rules[0].place_pods[1]]`,
+	},
+	{
+		name: "merged placements with the same volume name",
+		rules: `
+rules:
+- strategy: merge
+  place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: a
+      containers:
+        worker:
+          volume_mounts:
+          - name: certs
+            mountPath: /etc/certs
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: b
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/etc/certs","name":"certs"}]} {"op":"add","path":"/spec/volumes/-","value":{"configMap":{"name":"b"},"name":"certs"}}]`,
+		expectFired: `[rules[0].place_pods[0] rules[0].place_pods[1]]`,
+	},
+	{
+		name: "merged placements with the same volume name by priority",
+		rules: `
+rules:
+- strategy: merge
+  place_pods:
+  - pods:
+      - namespace: ""
+    priority: 10
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: a
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: b
+      containers:
+        worker:
+          volume_mounts:
+          - name: certs
+            mountPath: /etc/certs
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/etc/certs","name":"certs"}]} {"op":"add","path":"/spec/volumes/-","value":{"configMap":{"name":"a"},"name":"certs"}}]`,
+		expectFired: `[rules[0].place_pods[0] rules[0].place_pods[1]]`,
+	},
+	{
+		name: "repeated volume name keeps the first",
+		rules: `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - name: certs
+        configMap:
+          name: a
+      - name: certs
+        configMap:
+          name: b
+      containers:
+        worker:
+          volume_mounts:
+          - name: certs
+            mountPath: /etc/certs
+`,
+		expected:    `[{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"mountPath":"/etc/certs","name":"certs"}]} {"op":"add","path":"/spec/volumes/-","value":{"configMap":{"name":"a"},"name":"certs"}}]`,
+		expectFired: `[rules[0].place_pods[0]]`,
+	},
+}
+
+// go test -count 1 -run '^TestVolumes$' ./cmd/webhook
+func TestVolumes(t *testing.T) {
+
+	var defaultMode int32 = 0o644
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:         "app",
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				},
+				{Name: "worker"},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{
+						HostPath: &corev1.HostPathVolumeSource{Path: "/mnt/data"},
+					},
+				},
+				{
+					Name: "ca-bundle",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "corp-ca-bundle"},
+							DefaultMode:          &defaultMode, // set by API server defaults
+						},
+					},
+				},
+			},
+		},
+	}
+
+	runPodRuleCases(t, pod, volumesTestTable,
+		func(info podInfo, spec *corev1.PodSpec, ordered rulesConfig) []string {
+			return addPlacement(info, spec, ordered.PlacePods)
+		})
+}
+
+// go test -count 1 -run '^TestVolumesBad$' ./cmd/webhook
+func TestVolumesBad(t *testing.T) {
+	inputs := []string{
+		`
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      volumes:
+      - emptyDir: {}
+`,
+		`
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      containers:
+        app:
+          volume_mounts:
+          - name: tmp
+`,
+	}
+	for i, input := range inputs {
+		if _, err := newRules([]byte(input), true); err == nil {
+			t.Errorf("%d of %d: expected error for bad volume, got nil",
+				i+1, len(inputs))
+		}
+	}
+}
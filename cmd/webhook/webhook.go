@@ -70,7 +70,13 @@ func handlerWebhook(app *application, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg := fmt.Sprintf("%s: did not receive pod/daemontset/namespace, got: %s",
+	if kind, found := workloadKinds[admissionReviewRequest.Request.Resource]; found &&
+		app.conf.workloadTemplates {
+		handleWorkload(app, w, admissionReviewRequest, deserializer, kind)
+		return
+	}
+
+	msg := fmt.Sprintf("%s: did not receive pod/daemontset/namespace/workload, got: %s",
 		me, admissionReviewRequest.Request.Resource.Resource)
 	httpError(w, msg, 400)
 }
@@ -80,6 +86,8 @@ func handlePod(app *application, w http.ResponseWriter,
 
 	const me = "handlePod"
 
+	rules := app.rules.get() // consistent snapshot for the whole request
+
 	// Decode the pod from the AdmissionReview.
 	rawRequest := admissionReviewRequest.Request.Object.Raw
 	pod := corev1.Pod{}
@@ -91,6 +99,7 @@ func handlePod(app *application, w http.ResponseWriter,
 	}
 
 	namespace := admissionReviewRequest.Request.Namespace
+	operation := string(admissionReviewRequest.Request.Operation)
 	podName := pod.GetObjectMeta().GetName()
 	if podName == "" {
 		podName = pod.GetObjectMeta().GetGenerateName()
@@ -98,7 +107,10 @@ func handlePod(app *application, w http.ResponseWriter,
 
 	// Create a response.
 	admissionResponse := &admissionv1.AdmissionResponse{}
-	var patch string
+	mutated := pod.DeepCopy()      // changed by rules in enforce mode
+	auditOriginal := &pod          // changed by rules in enforce mode, before audit
+	auditMutated := pod.DeepCopy() // changed by rules in both modes
+	var auditFired []string        // rules in audit mode that would change the object
 
 	var ignore bool
 	if slices.Contains(app.conf.ignoreNamespaces, namespace) {
@@ -109,53 +121,59 @@ func handlePod(app *application, w http.ResponseWriter,
 		log.Printf("pod: %s/%s: ignored", namespace, podName)
 	} else {
 
-		var patchList []string
-
-		for _, r := range app.rules.Rules {
-
-			// remove tolerations and nodeSelector
-			tolerationRemovalList := removeTolerations(namespace, podName,
-				pod.Spec.PriorityClassName, pod.ObjectMeta.Labels,
-				pod.ObjectMeta.OwnerReferences, pod.Spec.Tolerations,
-				r.RestrictTolerations)
-
-			nodeSelectorRemovalList := removeNodeSelectors(namespace,
-				podName, pod.Spec.NodeSelector, app.conf.acceptNodeSelectors)
+		info := podInfo{
+			namespace:         namespace,
+			name:              podName,
+			priorityClassName: pod.Spec.PriorityClassName,
+			labels:            pod.ObjectMeta.Labels,
+			annotations:       pod.ObjectMeta.Annotations,
+			ownerReferences:   pod.ObjectMeta.OwnerReferences,
+			namespaceLabels:   app.namespaces.Load().labels(namespace),
+			containers:        pod.Spec.Containers,
+			initContainers:    pod.Spec.InitContainers,
+			serviceAccount:    pod.Spec.ServiceAccountName,
+			user:              admissionReviewRequest.Request.UserInfo.Username,
+			groups:            admissionReviewRequest.Request.UserInfo.Groups,
+		}
+		info.cel = newCELInput(admissionReviewRequest.Request, namespace,
+			info.namespaceLabels)
+
+		// all rule groups in evaluation order
+		var ordered rulesConfig
+
+		// the ephemeralcontainers subresource changes only ephemeral containers
+		ephemeral := admissionReviewRequest.Request.SubResource == subresourceEphemeralContainers
+		if ephemeral {
+			ordered = rules.ordered.forOperation(operation).forEphemeralContainers()
+		} else {
+			ordered = rules.ordered.forPodOperation(operation)
+		}
 
-			// add tolerations, nodeSelector, priorityClass, container env var
-			placementList := addPlacement(namespace, podName,
-				pod.Spec.PriorityClassName, pod.Spec.Priority,
-				pod.ObjectMeta.Labels, pod.ObjectMeta.OwnerReferences,
-				pod.Spec.Containers, r.PlacePods)
+		enforce, audit := ordered.splitMode(app.conf.dryRun)
 
-			// add resource requests/limits
-			resourceList := addResource(namespace, podName,
-				pod.Spec.PriorityClassName, pod.ObjectMeta.Labels,
-				pod.ObjectMeta.OwnerReferences,
-				pod.Spec.Containers, r.Resources, app.conf.debug)
+		// rules that changed the pod
+		fired := mutatePod(info, &mutated.Spec, enforce, app.conf.debug)
 
-			patchList = append(patchList, tolerationRemovalList...)
-			patchList = append(patchList, nodeSelectorRemovalList...)
-			patchList = append(patchList, placementList...)
-			patchList = append(patchList, resourceList...)
+		if !audit.empty() {
+			auditOriginal = mutated.DeepCopy()
+			auditFired = audit.keepFired(mutatePod(info, &auditMutated.Spec,
+				ordered, app.conf.debug))
 		}
 
-		if len(patchList) > 0 {
-			patch = "[" + strings.Join(patchList, ",") + "]"
+		// record rules that changed the pod,
+		// the subresource would drop the annotations anyway
+		if !ephemeral {
+			mutatedBy(&mutated.ObjectMeta, fired, rules.hash)
 		}
 	}
 
-	if app.conf.debug {
-		log.Printf("DEBUG %s: patch: '%s'",
-			me, patch)
-	}
+	setPatch(admissionResponse, admissionReviewRequest.Request, podName,
+		&pod, mutated, app.conf.debug)
+
+	setAudit(admissionResponse, admissionReviewRequest.Request, podName,
+		auditOriginal, auditMutated, auditFired)
 
 	admissionResponse.Allowed = true
-	if patch != "" {
-		patchType := admissionv1.PatchTypeJSONPatch
-		admissionResponse.PatchType = &patchType
-		admissionResponse.Patch = []byte(patch)
-	}
 
 	// Construct the response, which is just another AdmissionReview.
 	var admissionReviewResponse admissionv1.AdmissionReview
@@ -184,6 +202,8 @@ func handleDaemonset(app *application, w http.ResponseWriter,
 
 	const me = "handleDaemonset"
 
+	rules := app.rules.get() // consistent snapshot for the whole request
+
 	// Decode the daemonset from the AdmissionReview.
 	rawRequest := admissionReviewRequest.Request.Object.Raw
 	ds := appsv1.DaemonSet{}
@@ -195,11 +215,15 @@ func handleDaemonset(app *application, w http.ResponseWriter,
 	}
 
 	namespace := admissionReviewRequest.Request.Namespace
+	operation := string(admissionReviewRequest.Request.Operation)
 	dsName := ds.GetObjectMeta().GetName()
 
 	// Create a response.
 	admissionResponse := &admissionv1.AdmissionResponse{}
-	var patch string
+	mutated := ds.DeepCopy()      // changed by rules in enforce mode
+	auditOriginal := &ds          // changed by rules in enforce mode, before audit
+	auditMutated := ds.DeepCopy() // changed by rules in both modes
+	var auditFired []string       // rules in audit mode that would change the object
 
 	var ignore bool
 	if slices.Contains(app.conf.ignoreNamespaces, namespace) {
@@ -210,29 +234,37 @@ func handleDaemonset(app *application, w http.ResponseWriter,
 		log.Printf("daemonset: %s/%s: ignored", namespace, dsName)
 	} else {
 
-		var patchList []string
-
-		for _, r := range app.rules.Rules {
-			patchList = daemonsetNodeSelector(namespace, dsName,
-				ds.ObjectMeta.Labels, r.DisableDaemonsets)
+		info := daemonsetInfo{
+			namespace:       namespace,
+			name:            dsName,
+			labels:          ds.ObjectMeta.Labels,
+			annotations:     ds.ObjectMeta.Annotations,
+			namespaceLabels: app.namespaces.Load().labels(namespace),
 		}
+		info.cel = newCELInput(admissionReviewRequest.Request, namespace,
+			info.namespaceLabels)
 
-		if len(patchList) > 0 {
-			patch = "[" + strings.Join(patchList, ",") + "]"
+		// all rule groups in evaluation order
+		ordered := rules.ordered.forOperation(operation)
+		enforce, audit := ordered.splitMode(app.conf.dryRun)
+
+		daemonsetNodeSelector(info, &mutated.Spec.Template.Spec,
+			enforce.DisableDaemonsets)
+
+		if !audit.empty() {
+			auditOriginal = mutated
+			auditFired = audit.keepFired(daemonsetNodeSelector(info,
+				&auditMutated.Spec.Template.Spec, ordered.DisableDaemonsets))
 		}
 	}
 
-	if app.conf.debug {
-		log.Printf("DEBUG %s: patch: '%s'",
-			me, patch)
-	}
+	setPatch(admissionResponse, admissionReviewRequest.Request, dsName,
+		&ds, mutated, app.conf.debug)
+
+	setAudit(admissionResponse, admissionReviewRequest.Request, dsName,
+		auditOriginal, auditMutated, auditFired)
 
 	admissionResponse.Allowed = true
-	if patch != "" {
-		patchType := admissionv1.PatchTypeJSONPatch
-		admissionResponse.PatchType = &patchType
-		admissionResponse.Patch = []byte(patch)
-	}
 
 	// Construct the response, which is just another AdmissionReview.
 	var admissionReviewResponse admissionv1.AdmissionReview
@@ -262,6 +294,8 @@ func handleNamespace(app *application, w http.ResponseWriter,
 
 	const me = "handleNamespace"
 
+	rules := app.rules.get() // consistent snapshot for the whole request
+
 	// Decode the namespace from the AdmissionReview.
 	rawRequest := admissionReviewRequest.Request.Object.Raw
 	ns := corev1.Namespace{}
@@ -274,32 +308,40 @@ func handleNamespace(app *application, w http.ResponseWriter,
 
 	// Create a response.
 	admissionResponse := &admissionv1.AdmissionResponse{}
-	var patch string
+	mutated := ns.DeepCopy()      // changed by rules in enforce mode
+	auditOriginal := &ns          // changed by rules in enforce mode, before audit
+	auditMutated := ns.DeepCopy() // changed by rules in both modes
+	var auditFired []string       // rules in audit mode that would change the object
 
 	name := ns.GetObjectMeta().GetName()
+	operation := string(admissionReviewRequest.Request.Operation)
 
-	var patchList []string
-
-	for _, r := range app.rules.Rules {
-		patchList = namespaceAddLabels(name, ns.ObjectMeta.Labels,
-			r.NamespacesAddLabels)
+	info := namespaceInfo{
+		name:   name,
+		labels: ns.ObjectMeta.Labels,
+		cel: newCELInput(admissionReviewRequest.Request, name,
+			ns.ObjectMeta.Labels),
 	}
 
-	if len(patchList) > 0 {
-		patch = "[" + strings.Join(patchList, ",") + "]"
-	}
+	// all rule groups in evaluation order
+	ordered := rules.ordered.forOperation(operation)
+	enforce, audit := ordered.splitMode(app.conf.dryRun)
 
-	if app.conf.debug {
-		log.Printf("DEBUG %s: patch: '%s'",
-			me, patch)
+	namespaceAddLabels(info, &mutated.ObjectMeta, enforce.NamespacesAddLabels)
+
+	if !audit.empty() {
+		auditOriginal = mutated
+		auditFired = audit.keepFired(namespaceAddLabels(info,
+			&auditMutated.ObjectMeta, ordered.NamespacesAddLabels))
 	}
 
+	setPatch(admissionResponse, admissionReviewRequest.Request, name,
+		&ns, mutated, app.conf.debug)
+
+	setAudit(admissionResponse, admissionReviewRequest.Request, name,
+		auditOriginal, auditMutated, auditFired)
+
 	admissionResponse.Allowed = true
-	if patch != "" {
-		patchType := admissionv1.PatchTypeJSONPatch
-		admissionResponse.PatchType = &patchType
-		admissionResponse.Patch = []byte(patch)
-	}
 
 	// Construct the response, which is just another AdmissionReview.
 	var admissionReviewResponse admissionv1.AdmissionReview
@@ -323,6 +365,36 @@ func handleNamespace(app *application, w http.ResponseWriter,
 	w.Write(resp)
 }
 
+// mutatePod applies one rules section to the pod spec.
+// It returns the rules that changed the spec.
+func mutatePod(info podInfo, spec *corev1.PodSpec, r rulesConfig,
+	debug bool) []string {
+
+	// remove tolerations
+	tolerationFired := removeTolerations(info, spec, r.RestrictTolerations)
+
+	// remove nodeSelector keys.
+	// placements below add keys to the same spec, so the patch
+	// carries both steps together.
+	nodeSelectorFired := removeNodeSelectors(info, spec, r.RestrictNodeSelectors)
+
+	// add tolerations, nodeSelector, priorityClass, container env var
+	placementFired := addPlacement(info, spec, r.PlacePods)
+
+	// add resource requests/limits
+	resourceFired := addResource(info, spec, r.Resources, debug)
+
+	// remove node affinity expressions
+	nodeAffinityFired := removeNodeAffinity(info, spec, r.RestrictNodeAffinity)
+
+	fired := addFired(tolerationFired, nodeSelectorFired...)
+	fired = addFired(fired, nodeAffinityFired...)
+	fired = addFired(fired, placementFired...)
+	fired = addFired(fired, resourceFired...)
+
+	return fired
+}
+
 func tolerationToString(podToleration corev1.Toleration) string {
 	return tolerationFieldsToString(podToleration.Key,
 		string(podToleration.Operator),
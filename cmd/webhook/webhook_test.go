@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"slices"
-	"strings"
+	"os"
+	"path/filepath"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -20,6 +20,10 @@ type tolerationTestCase struct {
 	priorityClassName  string
 	podLabels          string
 	podOwnerReferences string
+	namespaceLabels    string
+	serviceAccount     string
+	user               string
+	groups             []string
 	expectedIndices    string
 }
 
@@ -156,6 +160,37 @@ rules:
           kind: DaemonSet
 `
 
+const rulesNamespaceLabelCanHaveKey2 = `
+rules:
+- restrict_tolerations:
+    - toleration:
+        key: ^key2$
+      allowed_pods:
+        # match pods in namespaces labeled team=a*
+        - namespace_labels:
+            team: "regexp=^a"
+`
+
+const rulesCICanHaveDedicated = `
+rules:
+- restrict_tolerations:
+    - toleration:
+        key: ^dedicated$
+        value: ^ci$
+      allowed_pods:
+        # pods created by the ci service account
+        - service_account: ^ci$
+        # pods created directly by the ci-bot user
+        - requested_by_user: ^ci-bot$
+        # pods created by members of the ci-admins group
+        - requested_by_group: ^ci-admins$
+`
+
+const tolerationsDedicatedCI = `[
+    {"key":"key1","operator":"Exists"},
+    {"key":"dedicated","operator":"Equal","value":"ci","effect":"NoSchedule"}
+    ]`
+
 var tolerationTestTable = []tolerationTestCase{
 	{
 		testName:        "empty rule, empty toleration",
@@ -306,6 +341,74 @@ var tolerationTestTable = []tolerationTestCase{
 		podLabels:       `{"good":"POD"}`,
 		expectedIndices: "[1]",
 	},
+	{
+		testName:        "key2 allowed by namespace label",
+		rules:           rulesNamespaceLabelCanHaveKey2,
+		podTolerations:  tolerations3,
+		namespace:       "team-a",
+		podName:         "pod-1",
+		namespaceLabels: `{"team":"alpha"}`,
+		expectedIndices: "[]",
+	},
+	{
+		testName:        "key2 rejected by namespace label value",
+		rules:           rulesNamespaceLabelCanHaveKey2,
+		podTolerations:  tolerations3,
+		namespace:       "team-b",
+		podName:         "pod-1",
+		namespaceLabels: `{"team":"beta"}`,
+		expectedIndices: "[1]",
+	},
+	{
+		testName:        "dedicated=ci allowed by service account",
+		rules:           rulesCICanHaveDedicated,
+		podTolerations:  tolerationsDedicatedCI,
+		namespace:       "ci",
+		podName:         "pod-1",
+		serviceAccount:  "ci",
+		user:            "system:serviceaccount:kube-system:replicaset-controller",
+		expectedIndices: "[]",
+	},
+	{
+		testName:        "dedicated=ci rejected for other service account",
+		rules:           rulesCICanHaveDedicated,
+		podTolerations:  tolerationsDedicatedCI,
+		namespace:       "ci",
+		podName:         "pod-1",
+		serviceAccount:  "default",
+		user:            "system:serviceaccount:kube-system:replicaset-controller",
+		groups:          []string{"system:serviceaccounts", "system:authenticated"},
+		expectedIndices: "[1]",
+	},
+	{
+		testName:        "dedicated=ci allowed by requesting user",
+		rules:           rulesCICanHaveDedicated,
+		podTolerations:  tolerationsDedicatedCI,
+		namespace:       "ci",
+		podName:         "pod-1",
+		serviceAccount:  "default",
+		user:            "ci-bot",
+		expectedIndices: "[]",
+	},
+	{
+		testName:        "dedicated=ci allowed by requesting group",
+		rules:           rulesCICanHaveDedicated,
+		podTolerations:  tolerationsDedicatedCI,
+		namespace:       "ci",
+		podName:         "pod-1",
+		serviceAccount:  "default",
+		user:            "alice",
+		groups:          []string{"system:authenticated", "ci-admins"},
+		expectedIndices: "[]",
+	},
+	{
+		testName:        "key2 rejected for namespace without labels",
+		rules:           rulesNamespaceLabelCanHaveKey2,
+		podTolerations:  tolerations3,
+		namespace:       "default",
+		podName:         "pod-1",
+		expectedIndices: "[1]",
+	},
 }
 
 // go test -count 1 -run ^TestRestrictTolerations$ ./...
@@ -354,10 +457,27 @@ func TestRestrictTolerations(t *testing.T) {
 
 		t.Logf("podOwnerReferences: %v", podOwnerReferences)
 
-		list := removeTolerationsIndices(data.namespace, data.podName,
-			data.priorityClassName, podLabels,
-			podOwnerReferences,
-			podTolerations,
+		var namespaceLabels map[string]string
+		if data.namespaceLabels != "" {
+			errLab := json.Unmarshal([]byte(data.namespaceLabels), &namespaceLabels)
+			if errLab != nil {
+				t.Errorf("%s bad namespace labels: %v", testLabel, errLab)
+			}
+		}
+
+		pod := podInfo{
+			namespace:         data.namespace,
+			name:              data.podName,
+			priorityClassName: data.priorityClassName,
+			labels:            podLabels,
+			ownerReferences:   podOwnerReferences,
+			namespaceLabels:   namespaceLabels,
+			serviceAccount:    data.serviceAccount,
+			user:              data.user,
+			groups:            data.groups,
+		}
+
+		list, _ := removeTolerationsIndices(pod, podTolerations,
 			r.RestrictTolerations)
 
 		str := fmt.Sprintf("%v", list)
@@ -380,17 +500,207 @@ func TestRemoveNodeSelector(t *testing.T) {
 		"foo/bar~": "5",
 	}
 
-	acceptNodeSelectors := []string{"b", "d"}
-
-	expected := `{"op":"remove","path":"/spec/nodeSelector/a"},{"op":"remove","path":"/spec/nodeSelector/c~1x"},{"op":"remove","path":"/spec/nodeSelector/foo~1bar~0"}`
+	defaults, errDefaults := acceptNodeSelectorsRules([]string{"b", "d", "foo/bar"})
+	if errDefaults != nil {
+		t.Fatalf("default rules: %v", errDefaults)
+	}
 
-	list := removeNodeSelectors("namespace", "podname", nodeSelector, acceptNodeSelectors)
+	expected := `[{"op":"remove","path":"/spec/nodeSelector/a"} {"op":"remove","path":"/spec/nodeSelector/c~1x"} {"op":"remove","path":"/spec/nodeSelector/foo~1bar~0"}] [accept_node_selectors]`
 
-	slices.Sort(list)
+	// keys are removed in sorted order
+	pod := corev1.Pod{Spec: corev1.PodSpec{NodeSelector: nodeSelector}}
+	mutated := pod.DeepCopy()
+	fired := removeNodeSelectors(podInfo{namespace: "namespace", name: "podname"},
+		&mutated.Spec, defaults.RestrictNodeSelectors)
 
-	result := strings.Join(list, ",")
+	result := diffString(t, &pod, mutated) + fmt.Sprintf(" %v", fired)
 
 	if result != expected {
 		t.Errorf("result:%s mismatched expected:%s", result, expected)
 	}
 }
+
+// go test -count 1 -run '^TestRemoveAndAddNodeSelector$' ./cmd/webhook
+func TestRemoveAndAddNodeSelector(t *testing.T) {
+
+	const rules = `
+rules:
+- place_pods:
+  - pods:
+      - namespace: ""
+    add:
+      node_selector:
+        pool: spot
+        team: b
+`
+	list, errRules := newRules([]byte(rules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	pod := corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{
+		"kubernetes.io/os": "linux",
+		"team":             "a",
+		"zone":             "x",
+	}}}
+
+	defaults, errDefaults := acceptNodeSelectorsRules([]string{"kubernetes.io/os", "team"})
+	if errDefaults != nil {
+		t.Fatalf("default rules: %v", errDefaults)
+	}
+	r := orderRules(append(list.Rules, defaults))
+
+	// removal and addition change the same copy, so the patch
+	// never removes a key and then replaces the whole map
+	mutated := pod.DeepCopy()
+	mutatePod(podInfo{namespace: "default", name: "pod-1"}, &mutated.Spec, r, false)
+
+	const expected = `[{"op":"add","path":"/spec/nodeSelector/pool","value":"spot"} {"op":"replace","path":"/spec/nodeSelector/team","value":"b"} {"op":"remove","path":"/spec/nodeSelector/zone"}]`
+
+	if result := diffString(t, &pod, mutated); result != expected {
+		t.Errorf("\n==      got:%s\n== expected:%s", result, expected)
+	}
+}
+
+const restrictNodeSelectorsRules = `
+rules:
+- restrict_node_selectors:
+  - rule_name: gpu-only-for-ml
+    node_selector:
+      key: ^accelerator$
+    allowed_pods:
+      - namespace: ^ml$
+    final: true
+  - rule_name: no-spot-pool
+    node_selector:
+      key: ^pool$
+      value: ^spot$
+    allowed_pods:
+      - namespace: ^batch$
+  - rule_name: no-accelerator
+    node_selector:
+      key: ^accelerator$
+`
+
+type restrictNodeSelectorsTestCase struct {
+	testName     string
+	namespace    string
+	nodeSelector map[string]string
+	expected     string
+}
+
+var restrictNodeSelectorsTestTable = []restrictNodeSelectorsTestCase{
+	{
+		testName:     "no restricted key",
+		namespace:    "default",
+		nodeSelector: map[string]string{"kubernetes.io/os": "linux", "pool": "stable"},
+		expected:     `[] []`,
+	},
+	{
+		testName:     "restricted keys removed",
+		namespace:    "default",
+		nodeSelector: map[string]string{"accelerator": "nvidia", "kubernetes.io/os": "linux", "pool": "spot"},
+		expected:     `[{"op":"remove","path":"/spec/nodeSelector/accelerator"} {"op":"remove","path":"/spec/nodeSelector/pool"}] [gpu-only-for-ml no-spot-pool]`,
+	},
+	{
+		testName:     "allowed pod keeps restricted key",
+		namespace:    "batch",
+		nodeSelector: map[string]string{"pool": "spot"},
+		expected:     `[] []`,
+	},
+	{
+		testName:     "final rule exempts pod from later rules",
+		namespace:    "ml",
+		nodeSelector: map[string]string{"accelerator": "nvidia", "pool": "spot"},
+		expected:     `[{"op":"remove","path":"/spec/nodeSelector/pool"}] [no-spot-pool]`,
+	},
+}
+
+// go test -count 1 -run '^TestRestrictNodeSelectors$' ./cmd/webhook
+func TestRestrictNodeSelectors(t *testing.T) {
+
+	list, errRules := newRules([]byte(restrictNodeSelectorsRules), true)
+	if errRules != nil {
+		t.Fatalf("rules: %v", errRules)
+	}
+
+	for i, data := range restrictNodeSelectorsTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(restrictNodeSelectorsTestTable), data.testName)
+		t.Run(name, func(t *testing.T) {
+			pod := corev1.Pod{Spec: corev1.PodSpec{NodeSelector: data.nodeSelector}}
+			mutated := pod.DeepCopy()
+			fired := removeNodeSelectors(podInfo{namespace: data.namespace, name: "pod-1"},
+				&mutated.Spec, list.ordered.RestrictNodeSelectors)
+
+			if got := diffString(t, &pod, mutated) + fmt.Sprintf(" %v", fired); got != data.expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, data.expected)
+			}
+		})
+	}
+}
+
+// go test -count 1 -run '^TestAcceptNodeSelectorsDefault$' ./cmd/webhook
+func TestAcceptNodeSelectorsDefault(t *testing.T) {
+
+	// team-a pods keep the pool key, which the default rule
+	// removes from every other pod. team-b pods keep the zone key,
+	// the default rule runs after user rules of negative priority.
+	const rules = `
+rules:
+- restrict_node_selectors:
+  - rule_name: pool-for-team-a
+    operations: [CREATE]
+    node_selector:
+      key: ^pool$
+    allowed_pods:
+      - namespace: ^team-a$
+    final: true
+  - rule_name: zone-for-team-b
+    operations: [CREATE]
+    priority: -10
+    node_selector:
+      key: ^zone$
+    allowed_pods:
+      - namespace: ^team-b$
+    final: true
+`
+	store := &rulesStore{}
+	defaults, errDefaults := acceptNodeSelectorsRules([]string{"kubernetes.io/os"})
+	if errDefaults != nil {
+		t.Fatalf("default rules: %v", errDefaults)
+	}
+	store.defaults = []rulesConfig{defaults}
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if _, err := store.reload(path, true); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	nodeSelector := map[string]string{"kubernetes.io/os": "linux", "disk": "ssd", "pool": "gpu", "zone": "a"}
+
+	for _, data := range []struct {
+		namespace string
+		operation string
+		expected  string
+	}{
+		{"default", operationCreate, `[{"op":"remove","path":"/spec/nodeSelector/disk"} {"op":"remove","path":"/spec/nodeSelector/pool"} {"op":"remove","path":"/spec/nodeSelector/zone"}] [accept_node_selectors pool-for-team-a zone-for-team-b]`},
+		{"default", operationUpdate, `[] []`}, // pod nodeSelector is immutable
+		{"team-a", operationCreate, `[{"op":"remove","path":"/spec/nodeSelector/disk"} {"op":"remove","path":"/spec/nodeSelector/zone"}] [accept_node_selectors zone-for-team-b]`},
+		{"team-b", operationCreate, `[{"op":"remove","path":"/spec/nodeSelector/disk"} {"op":"remove","path":"/spec/nodeSelector/pool"}] [accept_node_selectors pool-for-team-a]`},
+	} {
+		enforce, _ := store.get().ordered.forOperation(data.operation).splitMode(false)
+
+		pod := corev1.Pod{Spec: corev1.PodSpec{NodeSelector: nodeSelector}}
+		mutated := pod.DeepCopy()
+		fired := mutatePod(podInfo{namespace: data.namespace, name: "pod-1"},
+			&mutated.Spec, enforce, false)
+
+		if got := diffString(t, &pod, mutated) + fmt.Sprintf(" %v", fired); got != data.expected {
+			t.Errorf("%s %s:\n==      got:%s\n== expected:%s",
+				data.namespace, data.operation, got, data.expected)
+		}
+	}
+}
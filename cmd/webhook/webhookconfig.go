@@ -14,7 +14,8 @@ import (
 func createOrUpdateMutatingWebhookConfiguration(clientset *kubernetes.Clientset,
 	caPEM []byte, webhookConfigName,
 	webhookPath, webhookService, webhookNamespace, failurePolicy,
-	namespaceExcludeLabel, reinvocationPolicy string) error {
+	namespaceExcludeLabel, reinvocationPolicy string,
+	ops webhookOperations) error {
 
 	mutatingWebhookConfigV1Client := clientset.AdmissionregistrationV1()
 
@@ -42,41 +43,7 @@ func createOrUpdateMutatingWebhookConfiguration(clientset *kubernetes.Clientset,
 					Path:      &webhookPath,
 				},
 			},
-			Rules: []admissionregistrationv1.RuleWithOperations{
-				{
-					Operations: []admissionregistrationv1.OperationType{
-						admissionregistrationv1.Create,
-						admissionregistrationv1.Update,
-					},
-					Rule: admissionregistrationv1.Rule{
-						APIGroups:   []string{""},
-						APIVersions: []string{"v1"},
-						Resources:   []string{"pods"},
-					},
-				},
-				{
-					Operations: []admissionregistrationv1.OperationType{
-						admissionregistrationv1.Create,
-						admissionregistrationv1.Update,
-					},
-					Rule: admissionregistrationv1.Rule{
-						APIGroups:   []string{"apps"},
-						APIVersions: []string{"v1"},
-						Resources:   []string{"daemonsets"},
-					},
-				},
-				{
-					Operations: []admissionregistrationv1.OperationType{
-						admissionregistrationv1.Create,
-						admissionregistrationv1.Update,
-					},
-					Rule: admissionregistrationv1.Rule{
-						APIGroups:   []string{""},
-						APIVersions: []string{"v1"},
-						Resources:   []string{"namespaces"},
-					},
-				},
-			},
+			Rules: webhookRules(ops),
 			NamespaceSelector: &metav1.LabelSelector{
 				/*
 					MatchLabels: map[string]string{
@@ -143,3 +110,59 @@ func createOrUpdateMutatingWebhookConfiguration(clientset *kubernetes.Clientset,
 
 	return nil
 }
+
+// webhookRules registers only the operations used by the rules.
+func webhookRules(ops webhookOperations) []admissionregistrationv1.RuleWithOperations {
+	list := []admissionregistrationv1.RuleWithOperations{}
+
+	add := func(operations []admissionregistrationv1.OperationType,
+		apiGroup, resource string) {
+		if len(operations) == 0 {
+			return
+		}
+		list = append(list, admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{apiGroup},
+				APIVersions: []string{"v1"},
+				Resources:   []string{resource},
+			},
+		})
+	}
+
+	add(ops.pods, "", "pods")
+	add(ops.ephemeralContainers, "", "pods/ephemeralcontainers")
+	add(ops.workloads, "apps", "deployments")
+	add(ops.workloads, "apps", "statefulsets")
+	add(ops.workloads, "apps", "replicasets")
+	add(ops.jobs, "batch", "jobs")
+	add(ops.workloads, "batch", "cronjobs")
+	add(ops.daemonsets, "apps", "daemonsets")
+	add(ops.namespaces, "", "namespaces")
+
+	return list
+}
+
+// webhookConfigAutoupdate updates the webhook configuration whenever
+// reloaded rules change the operations in use.
+func webhookConfigAutoupdate(store *rulesStore, changed <-chan struct{},
+	applied webhookOperations, workloadTemplates bool,
+	update func(webhookOperations) error) {
+
+	const me = "webhookConfigAutoupdate"
+
+	for range changed {
+		ops := rulesOperations(store.get(), workloadTemplates)
+		if reflect.DeepEqual(ops, applied) {
+			continue
+		}
+		if err := update(ops); err != nil {
+			log.Printf("%s: ERROR: %v", me, err)
+			continue
+		}
+		applied = ops
+		log.Printf("%s: operations: pods=%v ephemeralcontainers=%v workloads=%v jobs=%v daemonsets=%v namespaces=%v",
+			me, ops.pods, ops.ephemeralContainers, ops.workloads, ops.jobs,
+			ops.daemonsets, ops.namespaces)
+	}
+}
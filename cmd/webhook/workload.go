@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// workloadKind describes a workload whose pod template gets the pod rules,
+// with WORKLOAD_TEMPLATES=true. Pod admission still applies the rules to
+// the pods created from the template.
+//
+// The template stands for the pods it will create, so it gets the pod
+// CREATE rules on both workload CREATE and UPDATE.
+type workloadKind struct {
+	newObject func() runtime.Object
+	template  func(runtime.Object) *corev1.PodTemplateSpec
+
+	// owner of the pods created from the template, for has_owner_reference.
+	// ownerIsWorkload means the workload itself owns the pods, otherwise
+	// the owner name is unknown at template admission.
+	ownerAPIVersion string
+	ownerKind       string
+	ownerIsWorkload bool
+
+	// skipControllerKind skips the workloads controlled by this kind
+	// (in the apps group), whose template is copied by the controller
+	// from its own template, already mutated. Mutating the copy again
+	// would make it drift from the controller template.
+	skipControllerKind string
+}
+
+var workloadKinds = map[metav1.GroupVersionResource]workloadKind{
+	{Group: "apps", Version: "v1", Resource: "deployments"}: {
+		newObject:       func() runtime.Object { return &appsv1.Deployment{} },
+		template:        func(o runtime.Object) *corev1.PodTemplateSpec { return &o.(*appsv1.Deployment).Spec.Template },
+		ownerAPIVersion: "apps/v1",
+		ownerKind:       "ReplicaSet",
+	},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: {
+		newObject:       func() runtime.Object { return &appsv1.StatefulSet{} },
+		template:        func(o runtime.Object) *corev1.PodTemplateSpec { return &o.(*appsv1.StatefulSet).Spec.Template },
+		ownerAPIVersion: "apps/v1",
+		ownerKind:       "StatefulSet",
+		ownerIsWorkload: true,
+	},
+	{Group: "apps", Version: "v1", Resource: "replicasets"}: {
+		newObject:          func() runtime.Object { return &appsv1.ReplicaSet{} },
+		template:           func(o runtime.Object) *corev1.PodTemplateSpec { return &o.(*appsv1.ReplicaSet).Spec.Template },
+		ownerAPIVersion:    "apps/v1",
+		ownerKind:          "ReplicaSet",
+		ownerIsWorkload:    true,
+		skipControllerKind: "Deployment",
+	},
+	{Group: "batch", Version: "v1", Resource: "jobs"}: {
+		newObject:       func() runtime.Object { return &batchv1.Job{} },
+		template:        func(o runtime.Object) *corev1.PodTemplateSpec { return &o.(*batchv1.Job).Spec.Template },
+		ownerAPIVersion: "batch/v1",
+		ownerKind:       "Job",
+		ownerIsWorkload: true,
+	},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}: {
+		newObject: func() runtime.Object { return &batchv1.CronJob{} },
+		template: func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+		},
+		ownerAPIVersion: "batch/v1",
+		ownerKind:       "Job",
+	},
+}
+
+// copiedTemplate reports whether the workload template is copied from
+// the template of its controller, see skipControllerKind.
+func (kind workloadKind) copiedTemplate(obj metav1.Object) bool {
+	if kind.skipControllerKind == "" {
+		return false
+	}
+	controller := metav1.GetControllerOf(obj)
+	if controller == nil || controller.Kind != kind.skipControllerKind {
+		return false
+	}
+	gv, errParse := schema.ParseGroupVersion(controller.APIVersion)
+	return errParse == nil && gv.Group == "apps"
+}
+
+// templatePodInfo holds the attributes of the pods that will be created
+// from the template, used to match pod rules. The pod name is the
+// workload name, and CEL rules see the pod built from the template.
+func templatePodInfo(kind workloadKind, request *admissionv1.AdmissionRequest,
+	name string, template *corev1.PodTemplateSpec,
+	namespaceLabels map[string]string) podInfo {
+
+	namespace := request.Namespace
+
+	controller := true
+	owner := metav1.OwnerReference{
+		APIVersion: kind.ownerAPIVersion,
+		Kind:       kind.ownerKind,
+		Controller: &controller,
+	}
+	if kind.ownerIsWorkload {
+		owner.Name = name
+	}
+
+	info := podInfo{
+		namespace:         namespace,
+		name:              name,
+		priorityClassName: template.Spec.PriorityClassName,
+		labels:            template.ObjectMeta.Labels,
+		annotations:       template.ObjectMeta.Annotations,
+		ownerReferences:   []metav1.OwnerReference{owner},
+		namespaceLabels:   namespaceLabels,
+		containers:        template.Spec.Containers,
+		initContainers:    template.Spec.InitContainers,
+		serviceAccount:    template.Spec.ServiceAccountName,
+		user:              request.UserInfo.Username,
+		groups:            request.UserInfo.Groups,
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       template.Spec,
+	}
+	pod.Name = name
+	pod.Namespace = namespace
+	pod.OwnerReferences = info.ownerReferences
+
+	podRequest := *request // shallow copy, only the object is replaced
+	raw, errJSON := json.Marshal(pod)
+	if errJSON != nil {
+		log.Printf("ERROR: templatePodInfo: %s/%s: encode pod: %v",
+			namespace, name, errJSON)
+	}
+	podRequest.Object = runtime.RawExtension{Raw: raw}
+
+	info.cel = newCELInput(&podRequest, namespace, namespaceLabels)
+
+	return info
+}
+
+func handleWorkload(app *application, w http.ResponseWriter,
+	admissionReviewRequest *admissionv1.AdmissionReview,
+	deserializer runtime.Decoder, kind workloadKind) {
+
+	const me = "handleWorkload"
+
+	rules := app.rules.get() // consistent snapshot for the whole request
+
+	resource := admissionReviewRequest.Request.Resource.Resource
+
+	// Decode the workload from the AdmissionReview.
+	rawRequest := admissionReviewRequest.Request.Object.Raw
+	obj := kind.newObject()
+	if _, _, err := deserializer.Decode(rawRequest, nil, obj); err != nil {
+		msg := fmt.Sprintf("%s: error decoding raw %s: %v",
+			me, resource, err)
+		httpError(w, msg, 500)
+		return
+	}
+
+	namespace := admissionReviewRequest.Request.Namespace
+	name := obj.(metav1.Object).GetName()
+
+	// Create a response.
+	admissionResponse := &admissionv1.AdmissionResponse{}
+	mutated := obj.DeepCopyObject()      // changed by rules in enforce mode
+	auditOriginal := obj                 // changed by rules in enforce mode, before audit
+	auditMutated := obj.DeepCopyObject() // changed by rules in both modes
+	var auditFired []string              // rules in audit mode that would change the object
+
+	var ignore bool
+	if slices.Contains(app.conf.ignoreNamespaces, namespace) {
+		ignore = true
+	}
+
+	if ignore {
+		log.Printf("%s: %s/%s: ignored", resource, namespace, name)
+	} else if kind.copiedTemplate(obj.(metav1.Object)) {
+		log.Printf("%s: %s/%s: ignored: template copied from %s",
+			resource, namespace, name, kind.skipControllerKind)
+	} else {
+
+		info := templatePodInfo(kind, admissionReviewRequest.Request, name,
+			kind.template(obj), app.namespaces.Load().labels(namespace))
+
+		// all rule groups in evaluation order, the template creates pods
+		ordered := rules.ordered.forOperation(operationCreate)
+		enforce, audit := ordered.splitMode(app.conf.dryRun)
+
+		// rules that changed the pod template
+		template := kind.template(mutated)
+		fired := mutatePod(info, &template.Spec, enforce, app.conf.debug)
+
+		if !audit.empty() {
+			auditOriginal = mutated.DeepCopyObject()
+			auditFired = audit.keepFired(mutatePod(info,
+				&kind.template(auditMutated).Spec, ordered, app.conf.debug))
+		}
+
+		// record rules that changed the pod template in the workload
+		// metadata, not in the template: a template change rolls out
+		// the pods. pod admission annotates the pods.
+		mutatedBy(mutated.(metav1.Object), fired, rules.hash)
+	}
+
+	setPatch(admissionResponse, admissionReviewRequest.Request, name,
+		obj, mutated, app.conf.debug)
+
+	setAudit(admissionResponse, admissionReviewRequest.Request, name,
+		auditOriginal, auditMutated, auditFired)
+
+	admissionResponse.Allowed = true
+
+	// Construct the response, which is just another AdmissionReview.
+	var admissionReviewResponse admissionv1.AdmissionReview
+	admissionReviewResponse.Response = admissionResponse
+	admissionReviewResponse.SetGroupVersionKind(admissionReviewRequest.GroupVersionKind())
+	admissionReviewResponse.Response.UID = admissionReviewRequest.Request.UID
+
+	resp, errMarshal := json.Marshal(admissionReviewResponse)
+	if errMarshal != nil {
+		msg := fmt.Sprintf("%s: error marshalling response json: %v",
+			me, errMarshal)
+		httpError(w, msg, 500)
+		return
+	}
+
+	if app.conf.debug {
+		log.Printf("DEBUG %s: response body: %v", me, string(resp))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+const workloadRules = `
+rules:
+- restrict_tolerations:
+  - toleration:
+      key: ^spot$
+    allowed_pods:
+      - has_owner_reference:
+          kind: StatefulSet
+  place_pods:
+  - rule_name: team-a
+    pods:
+      - labels:
+          team: a
+        cel: object.spec.containers.all(c, c.name != "sidecar")
+    add:
+      tolerations:
+        - key: dedicated
+          operator: Equal
+          value: team-a
+          effect: NoSchedule
+- restrict_node_selectors:
+  - node_selector:
+      key: ^accelerator$
+    allowed_pods:
+      - namespace: ^ml$
+    operations: [CREATE]
+`
+
+type workloadTestCase struct {
+	name      string
+	resource  string
+	operation admissionv1.Operation // default CREATE
+	object    string
+	enabled   bool
+	expected  string
+}
+
+var workloadTestTable = []workloadTestCase{
+	{
+		name:     "deployment",
+		resource: "deployments",
+		object:   `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"},"spec":{"template":{"metadata":{"labels":{"team":"a"}},"spec":{"containers":[{"name":"web"}],"tolerations":[{"key":"spot","operator":"Exists"}]}}}}`,
+		enabled:  true,
+		expected: `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"rules[0].restrict_tolerations[0],team-a","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"add","path":"/spec/template/spec/tolerations/0/effect","value":"NoSchedule"},{"op":"replace","path":"/spec/template/spec/tolerations/0/key","value":"dedicated"},{"op":"replace","path":"/spec/template/spec/tolerations/0/operator","value":"Equal"},{"op":"add","path":"/spec/template/spec/tolerations/0/value","value":"team-a"}]`,
+	},
+	{
+		name:     "statefulset owns its pods",
+		resource: "statefulsets",
+		object:   `{"apiVersion":"apps/v1","kind":"StatefulSet","metadata":{"name":"db","namespace":"default"},"spec":{"template":{"metadata":{},"spec":{"containers":[{"name":"db"}],"tolerations":[{"key":"spot","operator":"Exists"}]}}}}`,
+		enabled:  true,
+		expected: ``,
+	},
+	{
+		name:     "cronjob",
+		resource: "cronjobs",
+		object:   `{"apiVersion":"batch/v1","kind":"CronJob","metadata":{"name":"report","namespace":"default"},"spec":{"schedule":"@daily","jobTemplate":{"spec":{"template":{"metadata":{"labels":{"team":"a"}},"spec":{"containers":[{"name":"report"}]}}}}}}`,
+		enabled:  true,
+		expected: `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"team-a","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"add","path":"/spec/jobTemplate/spec/template/spec/tolerations","value":[{"effect":"NoSchedule","key":"dedicated","operator":"Equal","value":"team-a"}]}]`,
+	},
+	{
+		name:     "cel sees the pod from the template",
+		resource: "jobs",
+		object:   `{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"batch","namespace":"default"},"spec":{"template":{"metadata":{"labels":{"team":"a"}},"spec":{"containers":[{"name":"main"},{"name":"sidecar"}]}}}}`,
+		enabled:  true,
+		expected: ``,
+	},
+	{
+		name:      "deployment update gets the create rules",
+		resource:  "deployments",
+		operation: admissionv1.Update,
+		object:    `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"},"spec":{"template":{"metadata":{},"spec":{"containers":[{"name":"web"}],"nodeSelector":{"accelerator":"gpu"}}}}}`,
+		enabled:   true,
+		expected:  `[{"op":"add","path":"/metadata/annotations","value":{"webhook.udhos.github.io/mutated-by":"rules[1].restrict_node_selectors[0]","webhook.udhos.github.io/rules-hash":"HASH"}},{"op":"remove","path":"/spec/template/spec/nodeSelector"}]`,
+	},
+	{
+		name:     "disabled",
+		resource: "deployments",
+		object:   `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"},"spec":{"template":{"metadata":{"labels":{"team":"a"}},"spec":{"containers":[{"name":"web"}]}}}}`,
+		expected: `400`,
+	},
+}
+
+// go test -count 1 -run '^TestWorkloadTemplates$' ./cmd/webhook
+func TestWorkloadTemplates(t *testing.T) {
+
+	store := &rulesStore{}
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(workloadRules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if _, err := store.reload(path, true); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	hash := store.get().hash
+
+	for i, data := range workloadTestTable {
+		name := fmt.Sprintf("%d of %d: %s", i+1, len(workloadTestTable), data.name)
+		t.Run(name, func(t *testing.T) {
+			app := &application{
+				codecs: serializer.NewCodecFactory(runtime.NewScheme()),
+				rules:  store,
+			}
+			app.conf.workloadTemplates = data.enabled
+
+			operation := data.operation
+			if operation == "" {
+				operation = admissionv1.Create
+			}
+
+			got := workloadReview(t, app, data.resource, operation, data.object)
+
+			expected := strings.ReplaceAll(data.expected, "HASH", hash)
+
+			if got != expected {
+				t.Errorf("\n==      got:%s\n== expected:%s", got, expected)
+			}
+		})
+	}
+}
+
+// workloadReview sends the workload to the webhook and returns the patch,
+// or the HTTP status if not ok.
+func workloadReview(t *testing.T, app *application, resource string,
+	operation admissionv1.Operation, object string) string {
+
+	t.Helper()
+
+	group := "apps"
+	if resource == "jobs" || resource == "cronjobs" {
+		group = "batch"
+	}
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid-1",
+			Resource:  metav1.GroupVersionResource{Group: group, Version: "v1", Resource: resource},
+			Namespace: "default",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: []byte(object)},
+		},
+	}
+	body, errJSON := json.Marshal(review)
+	if errJSON != nil {
+		t.Fatalf("json: %v", errJSON)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handlerWebhook(app, rec, req)
+
+	if rec.Code != http.StatusOK {
+		return fmt.Sprint(rec.Code)
+	}
+
+	var resp admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	return string(resp.Response.Patch)
+}
+
+// go test -count 1 -run '^TestWorkloadDeploymentRollout$' ./cmd/webhook
+func TestWorkloadDeploymentRollout(t *testing.T) {
+
+	store := &rulesStore{}
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(workloadRules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if _, err := store.reload(path, true); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	app := &application{
+		codecs: serializer.NewCodecFactory(runtime.NewScheme()),
+		rules:  store,
+	}
+	app.conf.workloadTemplates = true
+
+	// the CREATE only rule applies to the template on Deployment UPDATE
+	deployment := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","uid":"uid-web"},"spec":{"template":{"metadata":{"labels":{"app":"web"}},"spec":{"containers":[{"name":"web"}],"nodeSelector":{"accelerator":"gpu"}}}}}`
+
+	patchJSON := workloadReview(t, app, "deployments", admissionv1.Update, deployment)
+	patch, errDecode := jsonpatch.DecodePatch([]byte(patchJSON))
+	if errDecode != nil {
+		t.Fatalf("decode patch: %v: %s", errDecode, patchJSON)
+	}
+	patched, errApply := patch.Apply([]byte(deployment))
+	if errApply != nil {
+		t.Fatalf("apply patch: %v", errApply)
+	}
+
+	var d appsv1.Deployment
+	if err := json.Unmarshal(patched, &d); err != nil {
+		t.Fatalf("deployment: %v", err)
+	}
+	if len(d.Spec.Template.Spec.NodeSelector) != 0 {
+		t.Errorf("deployment UPDATE: nodeSelector=%v", d.Spec.Template.Spec.NodeSelector)
+	}
+
+	// the annotations go to the deployment, a rules edit changing
+	// the rules hash must not change the template and roll out the pods
+	if _, found := d.Annotations[annotationRulesHash]; !found {
+		t.Errorf("deployment UPDATE: missing annotation %s: %v",
+			annotationRulesHash, d.Annotations)
+	}
+	if len(d.Spec.Template.Annotations) != 0 {
+		t.Errorf("deployment UPDATE: template annotations=%v",
+			d.Spec.Template.Annotations)
+	}
+
+	// the ReplicaSet created by the Deployment controller copies the
+	// mutated template, and must be left alone, so it keeps matching
+	controller := true
+	rs := appsv1.ReplicaSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-1234",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       "web",
+				UID:        "uid-web",
+				Controller: &controller,
+			}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Template: d.Spec.Template},
+	}
+	rs.Spec.Template.Spec.NodeSelector = map[string]string{"accelerator": "gpu"} // rules changed since
+
+	rsJSON, errJSON := json.Marshal(rs)
+	if errJSON != nil {
+		t.Fatalf("replicaset: %v", errJSON)
+	}
+	if got := workloadReview(t, app, "replicasets", admissionv1.Create, string(rsJSON)); got != "" {
+		t.Errorf("replicaset CREATE: unexpected patch: %s", got)
+	}
+
+	// a ReplicaSet without Deployment still gets the rules
+	rs.OwnerReferences = nil
+	rsJSON, errJSON = json.Marshal(rs)
+	if errJSON != nil {
+		t.Fatalf("replicaset: %v", errJSON)
+	}
+	if got := workloadReview(t, app, "replicasets", admissionv1.Create, string(rsJSON)); got == "" {
+		t.Errorf("standalone replicaset CREATE: missing patch")
+	}
+}